@@ -0,0 +1,447 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/minio/minio-go/pkg/set"
+)
+
+// Admin API - JSON endpoints for operators, served on a unix socket separate from the docker plugin socket.
+// The socket is only accessible to root, the endpoints are listed in the Readme.
+// ex: $ curl --unix-socket /run/minfs/admin.sock http://minfs/volumes
+const defaultAdminSocket = "/run/minfs/admin.sock"
+
+// `adminError` is the body of every failed admin request.
+type adminError struct {
+	Err string
+}
+
+// `holdersResponse` lists the containers holding the mount of a volume.
+type holdersResponse struct {
+	Volume   string
+	MountIDs []string
+}
+
+// `driverState` is the dump of the driver returned by `/state`.
+type driverState struct {
+	MountRoot string
+	StateFile string
+	// ID of the key encrypting the saved credentials, empty if they are saved in plain text.
+	StateKeyID string
+	Backends   []string
+	Volumes    []volumeDump
+}
+
+// `volumeDump` is a volume as held by the driver, with its credentials masked.
+type volumeDump struct {
+	Name       string
+	Mountpoint string
+	Endpoint   string
+	Bucket     string
+	Region     string
+	Backend    string
+	Server     string
+	AccessKey  string
+	SecretKey  string
+	MountIDs   []string
+	Status     map[string]interface{}
+}
+
+// listen on the admin socket and serve the admin API, returns once the listener fails.
+func (d *minfsDriver) serveAdmin(socketPath string) error {
+	if err := createDir(filepath.Dir(socketPath)); err != nil {
+		return err
+	}
+	// remove the socket left behind by an earlier run.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := listenPrivateUnix(socketPath)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("admin API listening on %s", socketPath)
+	return http.Serve(l, d.adminHandler())
+}
+
+// listen on a unix socket only root can connect to.
+// The socket is created inside a directory only root can enter, and moved to `socketPath` once its mode is set,
+// so that no other user can connect in between.
+func listenPrivateUnix(socketPath string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(socketPath), ".admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, filepath.Base(socketPath))
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(tmpPath, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, socketPath); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// return the handler of the admin API.
+func (d *minfsDriver) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/volumes", d.handleAdminVolumes)
+	mux.HandleFunc("/volumes/", d.handleAdminVolume)
+	mux.HandleFunc("/credentials/rotate", d.handleRotateCredentials)
+	mux.HandleFunc("/state", d.handleAdminState)
+	mux.HandleFunc("/state/rekey", d.handleRekeyState)
+	mux.HandleFunc("/version", handleAdminVersion)
+	return mux
+}
+
+// GET /volumes
+func (d *minfsDriver) handleAdminVolumes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	d.RLock()
+	var names []string
+	for name := range d.mounts {
+		names = append(names, name)
+	}
+	d.RUnlock()
+	sort.Strings(names)
+
+	vols := []*volume.Volume{}
+	for _, name := range names {
+		// the volume could have been removed in between.
+		if vol, err := d.volumeWithUsage(name); err == nil {
+			vols = append(vols, vol)
+		}
+	}
+	writeJSON(w, http.StatusOK, vols)
+}
+
+// GET /volumes/<name>, GET /volumes/<name>/holders, POST /volumes/<name>/unmount, POST /volumes/<name>/remount
+func (d *minfsDriver) handleAdminVolume(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/volumes/"), "/")
+	name := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	if name == "" || len(parts) > 2 {
+		writeJSON(w, http.StatusNotFound, adminError{Err: fmt.Sprintf("unknown path %s", r.URL.Path)})
+		return
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"method": "admin " + action,
+		"volume": name,
+	})
+
+	switch action {
+	case "":
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		vol, err := d.volumeWithUsage(name)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, adminError{Err: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, vol)
+	case "holders":
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		d.RLock()
+		v, ok := d.mounts[name]
+		var ids []string
+		if ok {
+			ids = v.mountIDs.ToSlice()
+		}
+		d.RUnlock()
+		if !ok {
+			writeJSON(w, http.StatusNotFound, adminError{Err: fmt.Sprintf("volume %s not found", name)})
+			return
+		}
+		writeJSON(w, http.StatusOK, holdersResponse{Volume: name, MountIDs: ids})
+	case "unmount":
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+		log.Info("Force unmount requested.")
+		ids, err := d.forceUnmount(name)
+		if err != nil {
+			log.Error(err)
+			writeJSON(w, http.StatusInternalServerError, adminError{Err: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, holdersResponse{Volume: name, MountIDs: ids})
+	case "remount":
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+		log.Info("Remount requested.")
+		if err := d.remount(name); err != nil {
+			log.Error(err)
+			writeJSON(w, http.StatusInternalServerError, adminError{Err: err.Error()})
+			return
+		}
+		vol, err := d.volumeWithUsage(name)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, adminError{Err: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, vol)
+	default:
+		writeJSON(w, http.StatusNotFound, adminError{Err: fmt.Sprintf("unknown path %s", r.URL.Path)})
+	}
+}
+
+// POST /credentials/rotate
+func (d *minfsDriver) handleRotateCredentials(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	var req rotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Err: err.Error()})
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"method":   "admin rotate credentials",
+		"volume":   req.Volume,
+		"endpoint": req.Endpoint,
+	}).Info("Credential rotation requested.")
+
+	resp, err := d.rotateCredentials(req)
+	if err != nil {
+		logrus.Error(err)
+		writeJSON(w, http.StatusInternalServerError, adminError{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GET /state
+func (d *minfsDriver) handleAdminState(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, d.dumpState())
+}
+
+// POST /state/rekey
+func (d *minfsDriver) handleRekeyState(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	logrus.WithField("method", "admin rekey state").Info("State key rotation requested.")
+
+	resp, err := d.rekeyState()
+	if err != nil {
+		logrus.Error(err)
+		writeJSON(w, http.StatusInternalServerError, adminError{Err: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GET /version
+func handleAdminVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, http.StatusOK, getVersionInfo())
+}
+
+// return the volume with its status, including the bucket usage if it is enabled.
+func (d *minfsDriver) volumeWithUsage(name string) (*volume.Volume, error) {
+	resp := d.Get(volume.Request{Name: name})
+	if resp.Err != "" {
+		return nil, fmt.Errorf("%s", resp.Err)
+	}
+	return resp.Volume, nil
+}
+
+// forceUnmount - Unmounts the volume even though containers are holding it,
+// used to recover from a mount which docker lost track of.
+// The released IDs are returned, their later `Unmount` calls from docker are no-ops.
+func (d *minfsDriver) forceUnmount(name string) ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	v, ok := d.mounts[name]
+	if !ok {
+		return nil, fmt.Errorf("volume %s not found", name)
+	}
+	if v.remounting {
+		return nil, fmt.Errorf("volume %s is being remounted, try again", name)
+	}
+	ids := v.mountIDs.ToSlice()
+	if err := d.unmountVolume(*v); err != nil {
+		withMountOutput(logrus.WithFields(logrus.Fields{
+			"mountpount": v.mountPoint,
+			"backend":    v.config.backend,
+		}), err).Errorf("Unmount failed: <ERROR> %v", err)
+		return nil, err
+	}
+	v.mountIDs = set.NewStringSet()
+	v.credentialsPending = false
+	v.health = volumeHealth{}
+	d.saveMountIDs("force unmount", name)
+	return ids, nil
+}
+
+// remount - Unmounts and mounts the volume again, the containers holding it keep holding it.
+// Used to recover a broken mount, or to apply rotated credentials to a volume in use.
+// A hung FUSE mount can block the helpers for long, they run without holding the driver lock.
+func (d *minfsDriver) remount(name string) error {
+	d.Lock()
+	v, ok := d.mounts[name]
+	if !ok {
+		d.Unlock()
+		return fmt.Errorf("volume %s not found", name)
+	}
+	if v.mountIDs.IsEmpty() {
+		d.Unlock()
+		return fmt.Errorf("volume %s is not mounted", name)
+	}
+	if v.remounting {
+		d.Unlock()
+		return fmt.Errorf("volume %s is already being remounted", name)
+	}
+	v.remounting = true
+	mount := *v
+	d.Unlock()
+
+	expiresAt, err := d.remountVolume(name, mount)
+
+	d.Lock()
+	defer d.Unlock()
+	v.remounting = false
+	if err != nil {
+		v.setDegraded(err)
+		return err
+	}
+	v.lastError = ""
+	v.credentialsPending = false
+	v.credentialsExpireAt = expiresAt
+	// the last container released the volume meanwhile, Unmount left the new mount to us.
+	if v.mountIDs.IsEmpty() {
+		if err := d.unmountVolume(*v); err != nil {
+			withMountOutput(logrus.WithField("volume", name), err).Errorf("Unmount after remount failed: <ERROR> %v", err)
+			v.setDegraded(err)
+			return err
+		}
+		v.health = volumeHealth{}
+	}
+	return nil
+}
+
+// run the unmount and mount helpers of `remount`.
+func (d *minfsDriver) remountVolume(name string, v mountInfo) (time.Time, error) {
+	// a broken mount can fail to unmount, mounting again tells whether it matters.
+	if err := d.unmountVolume(v); err != nil {
+		withMountOutput(logrus.WithField("volume", name), err).Warnf("Unmount before remount failed. <ERROR> %v", err)
+	}
+	if err := createDir(v.mountPoint); err != nil {
+		return time.Time{}, err
+	}
+	return d.mountVolume(v)
+}
+
+// return the dump of the driver state, the keys of the volumes are masked.
+func (d *minfsDriver) dumpState() driverState {
+	d.RLock()
+	defer d.RUnlock()
+
+	state := driverState{
+		MountRoot:  d.mountRoot,
+		StateFile:  d.store.path,
+		StateKeyID: d.store.keys.currentID(),
+		Backends:   mounterNames(),
+		Volumes:    []volumeDump{},
+	}
+	for name, v := range d.mounts {
+		state.Volumes = append(state.Volumes, volumeDump{
+			Name:       name,
+			Mountpoint: v.mountPoint,
+			Endpoint:   v.config.endpoint,
+			Bucket:     v.config.bucket,
+			Region:     v.config.region,
+			Backend:    v.config.backend,
+			Server:     v.config.server,
+			AccessKey:  maskSecret(v.config.accessKey),
+			SecretKey:  maskSecret(v.config.secretKey),
+			MountIDs:   v.mountIDs.ToSlice(),
+			Status:     v.status(),
+		})
+	}
+	sort.Slice(state.Volumes, func(i, j int) bool { return state.Volumes[i].Name < state.Volumes[j].Name })
+	return state
+}
+
+// mask a credential, only whether it is set is shown.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "*****"
+}
+
+// reply with `405 Method Not Allowed` unless the request uses `method`.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, adminError{Err: fmt.Sprintf("method %s not allowed", r.Method)})
+	return false
+}
+
+// write `v` as JSON response with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if e, ok := v.(adminError); ok {
+		v = adminError{Err: redact(e.Err)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logrus.Errorf("Unable to write admin response. <ERROR> %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// Version and CommitID of the binary, set while building the release,
+// $ go build -ldflags "-X main.Version=2017-03-01T00:00:00Z -X main.CommitID=<sha>"
+var (
+	Version  = "DEVELOPMENT.GOGET"
+	CommitID = "DEVELOPMENT.GOGET"
+)
+
+// `versionInfo` is printed by `minfs version`, and served by the admin API for the running plugin.
+type versionInfo struct {
+	Version   string
+	CommitID  string
+	GoVersion string
+}
+
+// return the version of this binary.
+func getVersionInfo() versionInfo {
+	return versionInfo{
+		Version:   Version,
+		CommitID:  CommitID,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// `command` is a subcommand of the binary, `minfs <name> [flags] [args]`.
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) int
+}
+
+// The subcommands, other than `serve` they talk to the admin API of the running plugin.
+var commands = map[string]command{
+	"serve":   {"serve [flags]", "start the docker volume plugin (default).", runServe},
+	"ls":      {"ls [flags]", "list the volumes with their state.", runList},
+	"inspect": {"inspect [flags] <volume>", "show the full status of a volume.", runInspect},
+	"remount": {"remount [flags] <volume>", "unmount and mount a volume again, its containers keep it.", runRemount},
+	"doctor":  {"doctor [flags]", "check the host and the volumes for common problems.", runDoctor},
+	"rekey":   {"rekey [flags]", "re-encrypt the saved credentials with the state key, read again from its source.", runRekey},
+	"version": {"version [flags]", "print the version of the binary and of the running plugin.", runVersion},
+}
+
+// run the subcommand, returns the exit status of the binary.
+func runCommand(name string, args []string) int {
+	if name == "help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "minfs: unknown command \"%s\"\n\n", name)
+		printUsage(os.Stderr)
+		return 2
+	}
+	return cmd.run(args)
+}
+
+// print the list of subcommands.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: minfs <command> [flags] [args]")
+	fmt.Fprintln(w)
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", commands[name].usage, commands[name].help)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run `minfs <command> -h` for the flags of a command.")
+}
+
+// `minfs serve`, only returns once the plugin stops serving.
+func runServe(args []string) int {
+	if err := serve(args); err != nil {
+		logrus.Error(err)
+		return 1
+	}
+	return 0
+}
+
+// `cliFlags` are the flags shared by the commands talking to the running plugin.
+type cliFlags struct {
+	*flag.FlagSet
+	adminSocket *string
+	json        *bool
+}
+
+// return the flags of a client command.
+func newCLIFlags(name string) cliFlags {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	return cliFlags{
+		FlagSet:     flags,
+		adminSocket: flags.String("admin-socket", defaultAdminSocket, "unix socket of the admin API of the running plugin."),
+		json:        flags.Bool("json", false, "print JSON instead of a table."),
+	}
+}
+
+// parse the flags, and verify that exactly `nArgs` arguments are left.
+func (f cliFlags) parse(args []string, nArgs int) bool {
+	f.Parse(args)
+	if f.NArg() != nArgs {
+		fmt.Fprintf(os.Stderr, "minfs %s: expected %d argument(s), got %d. Run `minfs help` for the usage.\n", f.Name(), nArgs, f.NArg())
+		return false
+	}
+	return true
+}
+
+// `minfs ls`
+func runList(args []string) int {
+	f := newCLIFlags("ls")
+	if !f.parse(args, 0) {
+		return 2
+	}
+	var vols []*volume.Volume
+	if err := newAdminClient(*f.adminSocket).get("/volumes", &vols); err != nil {
+		return fail(err)
+	}
+	if *f.json {
+		return printJSON(vols)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tBACKEND\tENDPOINT\tBUCKET\tMOUNTS\tMOUNTPOINT")
+	for _, v := range vols {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", v.Name,
+			statusString(v.Status, "state"), statusString(v.Status, "backend"),
+			statusString(v.Status, "endpoint"), statusString(v.Status, "bucket"),
+			len(statusList(v.Status, "mountIDs")), v.Mountpoint)
+	}
+	tw.Flush()
+	return 0
+}
+
+// `minfs inspect <volume>`
+func runInspect(args []string) int {
+	f := newCLIFlags("inspect")
+	if !f.parse(args, 1) {
+		return 2
+	}
+	var vol volume.Volume
+	if err := newAdminClient(*f.adminSocket).get("/volumes/"+f.Arg(0), &vol); err != nil {
+		return fail(err)
+	}
+	if *f.json {
+		return printJSON(vol)
+	}
+	printVolume(os.Stdout, vol)
+	return 0
+}
+
+// `minfs remount <volume>`
+func runRemount(args []string) int {
+	f := newCLIFlags("remount")
+	if !f.parse(args, 1) {
+		return 2
+	}
+	var vol volume.Volume
+	if err := newAdminClient(*f.adminSocket).post("/volumes/"+f.Arg(0)+"/remount", nil, &vol); err != nil {
+		return fail(err)
+	}
+	if *f.json {
+		return printJSON(vol)
+	}
+	printVolume(os.Stdout, vol)
+	return 0
+}
+
+// `minfs rekey`
+func runRekey(args []string) int {
+	f := newCLIFlags("rekey")
+	if !f.parse(args, 0) {
+		return 2
+	}
+	var resp rekeyResponse
+	if err := newAdminClient(*f.adminSocket).post("/state/rekey", nil, &resp); err != nil {
+		return fail(err)
+	}
+	if *f.json {
+		return printJSON(resp)
+	}
+	fmt.Printf("Re-encrypted the credentials of %d volume(s) with the key %s.\n", resp.Volumes, resp.KeyID)
+	return 0
+}
+
+// `minfs version`, the running plugin is reported only if it can be reached.
+func runVersion(args []string) int {
+	f := newCLIFlags("version")
+	if !f.parse(args, 0) {
+		return 2
+	}
+	versions := map[string]interface{}{"client": getVersionInfo()}
+	var server versionInfo
+	if err := newAdminClient(*f.adminSocket).get("/version", &server); err != nil {
+		versions["serverError"] = err.Error()
+	} else {
+		versions["server"] = server
+	}
+	if *f.json {
+		return printJSON(versions)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tVERSION\tCOMMIT\tGO")
+	client := getVersionInfo()
+	fmt.Fprintf(tw, "client\t%s\t%s\t%s\n", client.Version, client.CommitID, client.GoVersion)
+	if err, ok := versions["serverError"]; ok {
+		fmt.Fprintf(tw, "server\tunreachable: %s\n", err)
+	} else {
+		fmt.Fprintf(tw, "server\t%s\t%s\t%s\n", server.Version, server.CommitID, server.GoVersion)
+	}
+	tw.Flush()
+	return 0
+}
+
+// The FUSE client required on the host by each backend, `builtin` and `noop` don't need one.
+var backendHelpers = map[string]string{
+	"minfs":  "mount.minfs",
+	"s3fs":   "s3fs",
+	"goofys": "goofys",
+	"rclone": "rclone",
+}
+
+// `doctorCheck` is the result of a single check of `minfs doctor`.
+type doctorCheck struct {
+	Check  string
+	OK     bool
+	Detail string
+}
+
+// `minfs doctor` - Verifies that FUSE is usable on the host, that the helpers of the backends in use
+// are installed, and reports the volumes which are degraded or waiting for rotated credentials.
+// Exits with 1 if any of the checks failed.
+func runDoctor(args []string) int {
+	f := newCLIFlags("doctor")
+	if !f.parse(args, 0) {
+		return 2
+	}
+
+	var checks []doctorCheck
+	add := func(check string, err error, detail string) {
+		c := doctorCheck{Check: check, OK: err == nil, Detail: detail}
+		if err != nil {
+			c.Detail = err.Error()
+		}
+		checks = append(checks, c)
+	}
+
+	_, err := os.Stat("/dev/fuse")
+	add("/dev/fuse", err, "present")
+	path, err := exec.LookPath("fusermount")
+	add("fusermount", err, path)
+
+	var state driverState
+	err = newAdminClient(*f.adminSocket).get("/state", &state)
+	add("admin API", err, *f.adminSocket)
+
+	// only the helpers of the backends in use are required, the default backend otherwise.
+	backends := map[string]bool{defaultBackend: len(state.Volumes) == 0}
+	for _, v := range state.Volumes {
+		backends[v.Backend] = true
+	}
+	var names []string
+	for name, used := range backends {
+		if _, ok := backendHelpers[name]; ok && used {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path, err := exec.LookPath(backendHelpers[name])
+		add("backend "+name, err, path)
+	}
+
+	for _, v := range state.Volumes {
+		var err error
+		detail := statusString(v.Status, "state")
+		if lastError := statusString(v.Status, "lastError"); lastError != "" {
+			err = fmt.Errorf("degraded: %s", lastError)
+		} else if pending, _ := v.Status["credentialsPending"].(bool); pending {
+			err = fmt.Errorf("rotated credentials are pending, remount the volume to apply them")
+		}
+		add("volume "+v.Name, err, detail)
+	}
+
+	status := 0
+	for _, c := range checks {
+		if !c.OK {
+			status = 1
+		}
+	}
+	if *f.json {
+		printJSON(checks)
+		return status
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, c := range checks {
+		result := "ok"
+		if !c.OK {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Check, result, c.Detail)
+	}
+	tw.Flush()
+	return status
+}
+
+// print the volume as a list of its status fields.
+func printVolume(w io.Writer, vol volume.Volume) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "name:\t%s\n", vol.Name)
+	fmt.Fprintf(tw, "mountpoint:\t%s\n", vol.Mountpoint)
+	var keys []string
+	for key := range vol.Status {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := vol.Status[key]
+		if list, ok := value.([]interface{}); ok {
+			var items []string
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+			value = strings.Join(items, ", ")
+		}
+		fmt.Fprintf(tw, "%s:\t%v\n", key, value)
+	}
+	tw.Flush()
+}
+
+// return a string field of the status, empty if it is not set.
+func statusString(status map[string]interface{}, key string) string {
+	s, _ := status[key].(string)
+	return s
+}
+
+// return a list field of the status.
+func statusList(status map[string]interface{}, key string) []interface{} {
+	l, _ := status[key].([]interface{})
+	return l
+}
+
+// print `v` as indented JSON.
+func printJSON(v interface{}) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+// print the error, returns the exit status of a failed command.
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "minfs: %v\n", err)
+	return 1
+}
+
+// adminClient - Client of the admin API, see admin.go.
+type adminClient struct {
+	socket string
+	client *http.Client
+}
+
+// return a new instance of adminClient talking to the admin API on the unix socket.
+func newAdminClient(socket string) *adminClient {
+	return &adminClient{
+		socket: socket,
+		client: &http.Client{
+			Timeout: 2 * time.Minute,
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.DialTimeout("unix", socket, 5*time.Second)
+				},
+			},
+		},
+	}
+}
+
+// GET the path and decode the JSON response into `v`.
+func (c *adminClient) get(path string, v interface{}) error {
+	return c.do("GET", path, nil, v)
+}
+
+// POST `body` as JSON to the path and decode the JSON response into `v`.
+func (c *adminClient) post(path string, body, v interface{}) error {
+	return c.do("POST", path, body, v)
+}
+
+func (c *adminClient) do(method, path string, body, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	// the host is ignored, the request always goes to the socket.
+	req, err := http.NewRequest(method, "http://minfs"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to reach the plugin on %s, is it running? (%v)", c.socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var aErr adminError
+		if err = json.NewDecoder(resp.Body).Decode(&aErr); err != nil || aErr.Err == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s", aErr.Err)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
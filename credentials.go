@@ -0,0 +1,247 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Credential files - The keys of a volume can be read from files instead of being passed inline,
+// so that they don't show up in `docker volume inspect`, the shell history or the debug log.
+// $ docker volume create -d minfs --name <volume-name> -o access-key-file=minio/access -o secret-key-file=minio/secret ...
+// $ docker volume create -d minfs --name <volume-name> -o credentials=secret:minio-prod ...
+// Only the reference is saved with the volume, the files are read whenever the keys are needed,
+// so replacing a file rotates the keys of every volume referring to it at its next mount.
+// The files have to be inside `--secrets-dir` (default /run/secrets), relative paths are resolved against it.
+// A secret of `credentials=secret:<name>` is the file `<secrets-dir>/<name>` holding both keys,
+// access-key=...
+// secret-key=...
+
+const (
+	defaultSecretsDir = "/run/secrets"
+	// prefix of the value of `-o credentials=`.
+	secretRefPrefix = "secret:"
+)
+
+// directory of the credential files, set with `--secrets-dir`.
+var secretsDir = defaultSecretsDir
+
+// verify the options of `docker volume create` defining the keys, inline, in files or from a provider.
+// Each key has exactly one source, `credentials=`, `profile=` and `alias=` can't be combined with any other.
+// Without any of them the keys are looked up in the providers of the plugin, see providers.go.
+func validateCredentialOptions(options map[string]string) error {
+	keyOptions := []string{"access-key", "secret-key", "access-key-file", "secret-key-file", "credentials", "profile", "alias"}
+	for _, option := range []string{"credentials", "profile", "alias"} {
+		if options[option] == "" {
+			continue
+		}
+		for _, key := range keyOptions {
+			if key != option && options[key] != "" {
+				return fmt.Errorf("%s cannot be combined with %s=.", key, option)
+			}
+		}
+		if option == "credentials" {
+			_, err := secretName(options[option])
+			return err
+		}
+		return nil
+	}
+	if options["access-key"] == "" && options["secret-key"] == "" && options["access-key-file"] == "" && options["secret-key-file"] == "" {
+		return nil
+	}
+	for _, key := range []string{"access-key", "secret-key"} {
+		inline, file := options[key], options[key+"-file"]
+		if inline == "" && file == "" {
+			return fmt.Errorf("%s option cannot be empty, pass it with -o %s= or -o %s-file=.", key, key, key)
+		}
+		if inline != "" && file != "" {
+			return fmt.Errorf("%s and %s-file cannot be combined.", key, key)
+		}
+		if file != "" {
+			if _, err := secretFilePath(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// return the name of the secret of `credentials=secret:<name>`.
+func secretName(ref string) (string, error) {
+	if !strings.HasPrefix(ref, secretRefPrefix) {
+		return "", fmt.Errorf("Invalid credentials \"%s\", the form is credentials=secret:<name>.", ref)
+	}
+	name := strings.TrimPrefix(ref, secretRefPrefix)
+	if !validVolumeName.MatchString(name) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("Invalid secret name \"%s\", only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed.", name)
+	}
+	return name, nil
+}
+
+// return the path of a credential file, which has to be inside the secrets directory.
+// The plugin runs as root, any other file of the host could be sent to a server as a key.
+func secretFilePath(file string) (string, error) {
+	path := file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(secretsDir, path)
+	}
+	path = filepath.Clean(path)
+	if !insideDir(secretsDir, path) {
+		return "", fmt.Errorf("Invalid credential file \"%s\", it has to be inside the secrets directory %s.", file, secretsDir)
+	}
+	return path, nil
+}
+
+// return true if `path` is below `dir`, both are clean absolute paths.
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// read a file of the secrets directory.
+// A symlink in the directory could point to any file of the host, the file it resolves to has to be inside the directory too.
+func readSecretFile(path string) ([]byte, error) {
+	dir, err := filepath.EvalSymlinks(secretsDir)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	if !insideDir(dir, resolved) {
+		return nil, fmt.Errorf("%s points outside of the secrets directory %s", path, secretsDir)
+	}
+	return ioutil.ReadFile(resolved)
+}
+
+// read a key from a credential file, surrounding whitespace and the trailing newline are dropped.
+func readKeyFile(file string) (string, error) {
+	path, err := secretFilePath(file)
+	if err != nil {
+		return "", err
+	}
+	data, err := readSecretFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the credential file. <ERROR> %v", err)
+	}
+	key := string(bytes.TrimSpace(data))
+	if key == "" {
+		return "", fmt.Errorf("The credential file %s is empty.", path)
+	}
+	return key, nil
+}
+
+// read both keys from the secret `name` of the secrets directory.
+func readSecret(name string) (accessKey, secretKey string, err error) {
+	path := filepath.Join(secretsDir, name)
+	data, err := readSecretFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to read the secret %s. <ERROR> %v", name, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			// the line could be a key, it is never printed.
+			return "", "", fmt.Errorf("Invalid line in the secret %s, the lines are access-key=... and secret-key=...", name)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "access-key":
+			accessKey = strings.TrimSpace(kv[1])
+		case "secret-key":
+			secretKey = strings.TrimSpace(kv[1])
+		default:
+			return "", "", fmt.Errorf("Unknown key \"%s\" in the secret %s.", strings.TrimSpace(kv[0]), name)
+		}
+	}
+	if accessKey == "" || secretKey == "" {
+		return "", "", fmt.Errorf("The secret %s has to define access-key and secret-key.", name)
+	}
+	return accessKey, secretKey, nil
+}
+
+// hasCredentialRef - Returns whether the keys of the config are read from files or a provider instead of being saved with it.
+func (config serverConfig) hasCredentialRef() bool {
+	return config.accessKeyFile != "" || config.secretKeyFile != "" || config.secret != "" ||
+		config.fromEnv || config.awsProfile != "" || config.mcAlias != "" || config.sts == stsMetadata
+}
+
+// resolveCredentials - Returns the config with the keys read from the files or the provider it refers to,
+// replaced by temporary credentials for volumes created with `-o sts=`.
+// The references are cleared in the returned copy, the config saved with the volume keeps them.
+func resolveCredentials(config serverConfig) (serverConfig, error) {
+	var err error
+	switch {
+	case config.fromEnv:
+		config.accessKey, config.secretKey, _, err = envCredentials()
+	case config.awsProfile != "":
+		config.accessKey, config.secretKey, err = readAWSProfile(config.awsProfile)
+	case config.mcAlias != "":
+		config.accessKey, config.secretKey, err = readMcAlias(config.mcAlias)
+	}
+	if err != nil {
+		return config, err
+	}
+	if config.secret != "" {
+		accessKey, secretKey, err := readSecret(config.secret)
+		if err != nil {
+			return config, err
+		}
+		config.accessKey, config.secretKey = accessKey, secretKey
+	}
+	if config.accessKeyFile != "" {
+		key, err := readKeyFile(config.accessKeyFile)
+		if err != nil {
+			return config, err
+		}
+		config.accessKey = key
+	}
+	if config.secretKeyFile != "" {
+		key, err := readKeyFile(config.secretKeyFile)
+		if err != nil {
+			return config, err
+		}
+		config.secretKey = key
+	}
+	config.accessKeyFile, config.secretKeyFile, config.secret = "", "", ""
+	config.fromEnv, config.awsProfile, config.mcAlias = false, "", ""
+
+	config.registerSecrets()
+
+	// the keys found so far sign the request for the temporary credentials.
+	if config.sts != "" {
+		creds, err := temporaryCredentials.get(config)
+		if err != nil {
+			return config, err
+		}
+		config.accessKey, config.secretKey = creds.accessKey, creds.secretKey
+		config.sessionToken, config.expiresAt = creds.sessionToken, creds.expiresAt
+		config.sts = ""
+	}
+	config.registerSecrets()
+	return config, nil
+}
@@ -0,0 +1,107 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests that the credential files are only read inside the secrets directory, symlinks included.
+func TestReadKeyFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "minfs-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "secrets")
+	for _, d := range []string{dir, filepath.Join(dir, "minio")} {
+		if err = os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(dir, "minio", "access"): "Q3AM3UQ867SPQQA43P2F\n",
+		filepath.Join(dir, "minio-prod"):      "access-key=Q3AM3UQ867SPQQA43P2F\nsecret-key=zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG\n",
+		filepath.Join(root, "host-file"):      "not a key\n",
+		filepath.Join(root, "host-secret"):    "access-key=outside\nsecret-key=outside\n",
+	}
+	for path, content := range files {
+		if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(dir, "current"):     filepath.Join(dir, "minio", "access"),
+		filepath.Join(dir, "escape"):      filepath.Join(root, "host-file"),
+		filepath.Join(dir, "relative"):    "../host-file",
+		filepath.Join(dir, "minio-host"):  filepath.Join(root, "host-secret"),
+		filepath.Join(dir, "outside-dir"): root,
+	}
+	for link, target := range links {
+		if err = os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(dir string) { secretsDir = dir }(secretsDir)
+	secretsDir = dir
+
+	testCases := []struct {
+		file     string
+		expected string
+		err      string
+	}{
+		{"minio/access", "Q3AM3UQ867SPQQA43P2F", ""},
+		{filepath.Join(dir, "minio", "access"), "Q3AM3UQ867SPQQA43P2F", ""},
+		// symlinks resolving inside the directory are followed.
+		{"current", "Q3AM3UQ867SPQQA43P2F", ""},
+		// paths and symlinks leading out of the directory.
+		{"../host-file", "", "has to be inside the secrets directory"},
+		{filepath.Join(root, "host-file"), "", "has to be inside the secrets directory"},
+		{"escape", "", "points outside of the secrets directory"},
+		{"relative", "", "points outside of the secrets directory"},
+		{"outside-dir/host-file", "", "points outside of the secrets directory"},
+		{"missing", "", "no such file or directory"},
+	}
+	for i, testCase := range testCases {
+		actual, err := readKeyFile(testCase.file)
+		if testCase.err == "" {
+			if err != nil || actual != testCase.expected {
+				t.Errorf("Test %d: Expected \"%s\", got \"%s\" (%v)", i+1, testCase.expected, actual, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("Test %d: Expected an error containing \"%s\", got %v", i+1, testCase.err, err)
+		}
+		if strings.Contains(actual, "not a key") {
+			t.Errorf("Test %d: The file outside of the secrets directory was read.", i+1)
+		}
+	}
+
+	if accessKey, _, err := readSecret("minio-prod"); err != nil || accessKey != "Q3AM3UQ867SPQQA43P2F" {
+		t.Errorf("Expected the keys of the secret, got \"%s\" (%v)", accessKey, err)
+	}
+	if _, _, err := readSecret("minio-host"); err == nil || !strings.Contains(err.Error(), "points outside of the secrets directory") {
+		t.Errorf("Expected the secret pointing outside of the secrets directory to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,599 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/Sirupsen/logrus"
+	"github.com/minio/minio-go"
+	"golang.org/x/net/context"
+)
+
+// content type of the objects written through the filesystem.
+const fuseContentType = "application/octet-stream"
+
+// `builtinMounter` serves the bucket as a FUSE filesystem from within the plugin process,
+// using the same `minio.Client` which is used to create the bucket.
+// No FUSE client for S3 has to be installed on the host, only `fusermount` and /dev/fuse are needed.
+// $ docker volume create -d minfs --name <volume-name> -o backend=builtin ...
+// Since the filesystem is served by the plugin, the mounts go stale when the plugin exits,
+// they are mounted again by `reconcile` when the plugin restarts.
+type builtinMounter struct {
+	sync.Mutex
+	// FUSE connections of the active mounts, indexed by mountpoint.
+	conns map[string]*fuse.Conn
+	// filesystems of the active mounts, indexed by mountpoint.
+	filesystems map[string]*bucketFS
+}
+
+func newBuiltinMounter() *builtinMounter {
+	return &builtinMounter{
+		conns:       make(map[string]*fuse.Conn),
+		filesystems: make(map[string]*bucketFS),
+	}
+}
+
+func (m *builtinMounter) Mount(v mountInfo) error {
+	client, err := newMinioClient(v.config)
+	if err != nil {
+		return err
+	}
+
+	conn, err := fuse.Mount(v.mountPoint,
+		fuse.FSName(v.config.bucket),
+		fuse.Subtype("minfs"),
+		fuse.VolumeName(v.config.bucket),
+		// containers can run as any user.
+		fuse.AllowOther(),
+	)
+	if err != nil {
+		return newMountError("fusermount", err, nil)
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"mountpoint": v.mountPoint,
+		"endpoint":   v.config.endpoint,
+		"bucket":     v.config.bucket,
+	})
+	bfs := newBucketFS(client, v.config.bucket)
+	// registered before serving, so that the entries are always removed by the goroutine below.
+	m.Lock()
+	m.conns[v.mountPoint] = conn
+	m.filesystems[v.mountPoint] = bfs
+	m.Unlock()
+	go func() {
+		// Serve returns once the mountpoint is unmounted, by `Unmount` or from outside of the plugin.
+		if err := fs.Serve(conn, bfs); err != nil {
+			log.Errorf("FUSE server stopped. <ERROR> %v", err)
+		}
+		m.forget(v.mountPoint, conn)
+		conn.Close()
+	}()
+
+	// wait for the kernel to complete the mount.
+	<-conn.Ready
+	if conn.MountError != nil {
+		m.forget(v.mountPoint, conn)
+		conn.Close()
+		return newMountError("fusermount", conn.MountError, nil)
+	}
+
+	log.Debug("Bucket is served by the builtin FUSE filesystem.")
+	return nil
+}
+
+func (m *builtinMounter) Unmount(v mountInfo) error {
+	if err := fuse.Unmount(v.mountPoint); err != nil {
+		return newMountError("fusermount", err, nil)
+	}
+	// the connection is closed and forgotten by the goroutine serving it.
+	return nil
+}
+
+// forget the mount of `mountPoint` served by `conn`,
+// a later mount on the same mountpoint is kept.
+func (m *builtinMounter) forget(mountPoint string, conn *fuse.Conn) {
+	m.Lock()
+	defer m.Unlock()
+	if m.conns[mountPoint] != conn {
+		return
+	}
+	delete(m.conns, mountPoint)
+	delete(m.filesystems, mountPoint)
+}
+
+func (m *builtinMounter) Check(v mountInfo) error {
+	return checkFuseMount(v.mountPoint)
+}
+
+// UpdateCredentials - Replaces the Minio client of a live mount with one using the keys of `v.config`,
+// the requests in flight finish with the old client.
+func (m *builtinMounter) UpdateCredentials(v mountInfo) error {
+	m.Lock()
+	bfs, ok := m.filesystems[v.mountPoint]
+	m.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not mounted by the builtin backend", v.mountPoint)
+	}
+	client, err := newMinioClient(v.config)
+	if err != nil {
+		return err
+	}
+	bfs.setClient(client)
+	return nil
+}
+
+// bucketFS - A FUSE filesystem backed by a Minio bucket.
+// Object names are split at `/` into directories, directories only exist as prefixes of objects
+// (or as an empty `<prefix>/` object created by `mkdir`).
+// Files are read with ranged GETs, writes are buffered in a local temporary file
+// and uploaded as a whole object when the file is flushed.
+type bucketFS struct {
+	// guards `client`, which is replaced when the credentials of the volume are refreshed.
+	clientMu sync.RWMutex
+	client   *minio.Client
+	bucket   string
+
+	// guards `files`.
+	mu sync.Mutex
+	// the file nodes known to the kernel, indexed by object name,
+	// so that every open of a file shares the same write buffer.
+	files map[string]*bucketFile
+}
+
+func newBucketFS(client *minio.Client, bucket string) *bucketFS {
+	return &bucketFS{
+		client: client,
+		bucket: bucket,
+		files:  make(map[string]*bucketFile),
+	}
+}
+
+// return the current Minio client of the filesystem.
+func (f *bucketFS) minio() *minio.Client {
+	f.clientMu.RLock()
+	defer f.clientMu.RUnlock()
+	return f.client
+}
+
+// replace the Minio client of the filesystem.
+func (f *bucketFS) setClient(client *minio.Client) {
+	f.clientMu.Lock()
+	f.client = client
+	f.clientMu.Unlock()
+}
+
+// Root is the directory for the empty prefix.
+func (f *bucketFS) Root() (fs.Node, error) {
+	return &bucketDir{fs: f}, nil
+}
+
+// return the node for the object, creating it if the kernel doesn't know it yet.
+func (f *bucketFS) fileNode(key string, size int64, mtime time.Time) *bucketFile {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if file, ok := f.files[key]; ok {
+		return file
+	}
+	file := &bucketFile{fs: f, key: key, size: size, mtime: mtime}
+	f.files[key] = file
+	return file
+}
+
+// forget the node of the object, called once the kernel drops it.
+func (f *bucketFS) forgetFile(file *bucketFile) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.files[file.key] == file {
+		delete(f.files, file.key)
+	}
+}
+
+// verifies whether any object exists below the prefix.
+func (f *bucketFS) prefixExists(prefix string) (bool, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	for obj := range f.minio().ListObjectsV2(f.bucket, prefix, false, doneCh) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// map errors of the Minio client to errnos returned to the kernel.
+func fuseError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return fuse.ENOENT
+	case "AccessDenied":
+		return fuse.EPERM
+	}
+	logrus.Errorf("Minio request failed. <ERROR> %v", err)
+	return fuse.EIO
+}
+
+// bucketDir - A directory of the filesystem, the objects below `prefix`.
+type bucketDir struct {
+	fs *bucketFS
+	// "" for the root, otherwise the object name prefix ending with `/`.
+	prefix string
+}
+
+func (d *bucketDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	return nil
+}
+
+func (d *bucketDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	key := d.prefix + name
+
+	info, err := d.fs.minio().StatObject(d.fs.bucket, key)
+	if err == nil {
+		return d.fs.fileNode(key, info.Size, info.LastModified), nil
+	}
+	if code := minio.ToErrorResponse(err).Code; code != "NoSuchKey" && code != "NotFound" {
+		return nil, fuseError(err)
+	}
+	// not an object, check whether it is a directory.
+	exists, err := d.fs.prefixExists(key + "/")
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	if !exists {
+		return nil, fuse.ENOENT
+	}
+	return &bucketDir{fs: d.fs, prefix: key + "/"}, nil
+}
+
+func (d *bucketDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	var entries []fuse.Dirent
+	for obj := range d.fs.minio().ListObjectsV2(d.fs.bucket, d.prefix, false, doneCh) {
+		if obj.Err != nil {
+			return nil, fuseError(obj.Err)
+		}
+		name := strings.TrimPrefix(obj.Key, d.prefix)
+		// the object created by `mkdir` for the directory itself.
+		if name == "" {
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			entries = append(entries, fuse.Dirent{Name: strings.TrimSuffix(name, "/"), Type: fuse.DT_Dir})
+			continue
+		}
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+// directories only exist as prefixes, an empty `<prefix>/` object keeps the new directory visible until files are written to it.
+func (d *bucketDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	key := d.prefix + req.Name + "/"
+	if _, err := d.fs.minio().PutObject(d.fs.bucket, key, bytes.NewReader(nil), fuseContentType); err != nil {
+		return nil, fuseError(err)
+	}
+	return &bucketDir{fs: d.fs, prefix: key}, nil
+}
+
+func (d *bucketDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	file := d.fs.fileNode(d.prefix+req.Name, 0, time.Now())
+	// the new file is empty, it is uploaded on the first flush even if nothing is written.
+	h, err := file.openWriter(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, h, nil
+}
+
+func (d *bucketDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	key := d.prefix + req.Name
+	if !req.Dir {
+		if err := d.fs.minio().RemoveObject(d.fs.bucket, key); err != nil {
+			return fuseError(err)
+		}
+		return nil
+	}
+
+	// only empty directories can be removed.
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for obj := range d.fs.minio().ListObjectsV2(d.fs.bucket, key+"/", false, doneCh) {
+		if obj.Err != nil {
+			return fuseError(obj.Err)
+		}
+		if obj.Key != key+"/" {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	if err := d.fs.minio().RemoveObject(d.fs.bucket, key+"/"); err != nil {
+		return fuseError(err)
+	}
+	return nil
+}
+
+// objects are renamed by a server side copy, followed by removing the source.
+// Renaming a directory would need a copy of every object below it, EXDEV makes `mv` fall back
+// to copying the files one by one.
+func (d *bucketDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	target, ok := newDir.(*bucketDir)
+	if !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	oldKey := d.prefix + req.OldName
+	newKey := target.prefix + req.NewName
+
+	if _, err := d.fs.minio().StatObject(d.fs.bucket, oldKey); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return fuse.Errno(syscall.EXDEV)
+		}
+		return fuseError(err)
+	}
+	if err := d.fs.minio().CopyObject(d.fs.bucket, newKey, d.fs.bucket+"/"+oldKey, minio.NewCopyConditions()); err != nil {
+		return fuseError(err)
+	}
+	if err := d.fs.minio().RemoveObject(d.fs.bucket, oldKey); err != nil {
+		return fuseError(err)
+	}
+
+	d.fs.mu.Lock()
+	if file, ok := d.fs.files[oldKey]; ok {
+		delete(d.fs.files, oldKey)
+		file.Lock()
+		file.key = newKey
+		file.Unlock()
+		d.fs.files[newKey] = file
+	}
+	d.fs.mu.Unlock()
+	return nil
+}
+
+// bucketFile - A file of the filesystem, backed by a single object.
+type bucketFile struct {
+	// guards the fields below.
+	sync.Mutex
+	fs    *bucketFS
+	key   string
+	size  int64
+	mtime time.Time
+	// local copy of the object shared by all writable handles, nil while no handle is writing.
+	writer *fileWriter
+}
+
+// `fileWriter` buffers the content of a file opened for writing.
+type fileWriter struct {
+	f *os.File
+	// number of open writable handles.
+	refs int
+	// whether the buffer has changes which aren't uploaded yet.
+	dirty bool
+}
+
+func (file *bucketFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	file.Lock()
+	defer file.Unlock()
+
+	a.Mode = 0644
+	a.Size = uint64(file.size)
+	a.Mtime = file.mtime
+	a.Ctime = file.mtime
+	return nil
+}
+
+func (file *bucketFile) Forget() {
+	file.fs.forgetFile(file)
+}
+
+func (file *bucketFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Flags.IsReadOnly() {
+		return &fileHandle{file: file}, nil
+	}
+	return file.openWriter(req.Flags&fuse.OpenTruncate != 0)
+}
+
+// open a writable handle, the first one downloads the object into the local buffer.
+func (file *bucketFile) openWriter(truncate bool) (*fileHandle, error) {
+	file.Lock()
+	defer file.Unlock()
+
+	if file.writer == nil {
+		f, err := ioutil.TempFile("", "minfs-builtin-")
+		if err != nil {
+			return nil, err
+		}
+		// only the open descriptor is needed.
+		os.Remove(f.Name())
+
+		if !truncate && file.size > 0 {
+			obj, err := file.fs.minio().GetObject(file.fs.bucket, file.key)
+			if err != nil {
+				f.Close()
+				return nil, fuseError(err)
+			}
+			_, err = io.Copy(f, obj)
+			obj.Close()
+			if err != nil {
+				f.Close()
+				return nil, fuseError(err)
+			}
+		}
+		file.writer = &fileWriter{f: f}
+	}
+	if truncate {
+		if err := file.writer.f.Truncate(0); err != nil {
+			return nil, err
+		}
+		file.size = 0
+		file.writer.dirty = true
+	}
+	file.writer.refs++
+	return &fileHandle{file: file, writable: true}, nil
+}
+
+// upload the local buffer if it has changes, the caller holds the lock.
+func (file *bucketFile) upload() error {
+	if file.writer == nil || !file.writer.dirty {
+		return nil
+	}
+	r := io.NewSectionReader(file.writer.f, 0, file.size)
+	if _, err := file.fs.minio().PutObject(file.fs.bucket, file.key, r, fuseContentType); err != nil {
+		return fuseError(err)
+	}
+	file.writer.dirty = false
+	file.mtime = time.Now()
+	return nil
+}
+
+func (file *bucketFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if !req.Valid.Size() {
+		return nil
+	}
+
+	file.Lock()
+	writing := file.writer != nil
+	file.Unlock()
+	// the size of a file which isn't open for writing is changed by a write cycle of its own.
+	if !writing {
+		h, err := file.openWriter(req.Size == 0)
+		if err != nil {
+			return err
+		}
+		defer h.Release(ctx, nil)
+	}
+
+	file.Lock()
+	defer file.Unlock()
+	if err := file.writer.f.Truncate(int64(req.Size)); err != nil {
+		return err
+	}
+	file.size = int64(req.Size)
+	file.writer.dirty = true
+	if !writing {
+		return file.upload()
+	}
+	return nil
+}
+
+func (file *bucketFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	file.Lock()
+	defer file.Unlock()
+
+	return file.upload()
+}
+
+// `fileHandle` is an open file, reads go to the local buffer while the file is
+// open for writing and to the object otherwise.
+type fileHandle struct {
+	file     *bucketFile
+	writable bool
+	// object opened by the first read.
+	obj *minio.Object
+}
+
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	file := h.file
+	file.Lock()
+	defer file.Unlock()
+
+	buf := make([]byte, req.Size)
+	var n int
+	var err error
+	if file.writer != nil {
+		n, err = file.writer.f.ReadAt(buf, req.Offset)
+	} else {
+		if h.obj == nil {
+			if h.obj, err = file.fs.minio().GetObject(file.fs.bucket, file.key); err != nil {
+				return fuseError(err)
+			}
+		}
+		n, err = h.obj.ReadAt(buf, req.Offset)
+	}
+	if err != nil && err != io.EOF {
+		return fuseError(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *fileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	file := h.file
+	file.Lock()
+	defer file.Unlock()
+
+	if !h.writable || file.writer == nil {
+		return fuse.EPERM
+	}
+	n, err := file.writer.f.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return err
+	}
+	if end := req.Offset + int64(n); end > file.size {
+		file.size = end
+	}
+	file.writer.dirty = true
+	resp.Size = n
+	return nil
+}
+
+func (h *fileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if !h.writable {
+		return nil
+	}
+	h.file.Lock()
+	defer h.file.Unlock()
+
+	return h.file.upload()
+}
+
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if h.obj != nil {
+		h.obj.Close()
+	}
+	if !h.writable {
+		return nil
+	}
+
+	file := h.file
+	file.Lock()
+	defer file.Unlock()
+
+	// upload anything which wasn't flushed, the buffer is dropped with the last writable handle.
+	err := file.upload()
+	file.writer.refs--
+	if file.writer.refs == 0 {
+		file.writer.f.Close()
+		file.writer = nil
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-connections/sockets"
+)
+
+// Docker looks up plugins by name in this directory, `<name>.sock` for unix sockets.
+// No spec is written for the TCP listener, docker dials a `<name>.spec` URL without a client certificate,
+// remote daemons need a `<name>.json` spec with their own certificate, see the Readme.
+const pluginSockDir = "/run/docker/plugins"
+
+// verify that the plugin name can be used as the file name of its socket.
+func validatePluginName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\ \t\n") {
+		return fmt.Errorf("Invalid plugin name \"%s\".", name)
+	}
+	return nil
+}
+
+// return the path of the unix socket of the plugin, `socket` wins over the default derived from the name.
+func pluginSocketPath(name, socket string) string {
+	if socket != "" {
+		return socket
+	}
+	return filepath.Join(pluginSockDir, name+".sock")
+}
+
+// return the listener of the plugin socket.
+// The socket is created here instead of by `ServeUnix`, so that it can be closed on shutdown.
+func newPluginListener(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return sockets.NewUnixSocket(path, 0)
+}
+
+// return the TLS listener serving remote docker daemons.
+func newTCPListener(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// newTLSConfig - Returns the TLS config of the TCP listener.
+// Only clients presenting a certificate signed by the CA in `caFile` are accepted,
+// the plugin mounts buckets as root on the host and must not be reachable by anyone else.
+func newTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("--tls-cert, --tls-key and --tls-ca are required with --tcp-addr.")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load the TLS certificate. <ERROR> %v", err)
+	}
+	clientCAs, err := loadCAFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the client CA. <ERROR> %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -19,24 +19,28 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/set"
 )
 
 // Used for Plugin discovery.
 // Docker identifies the existence of an active plugin process by searching for
 // a unit socket file (.sock) in /run/docker/plugins/.
-// A unix server is started at the `socketAdress` to enable discovery of this plugin by docker.
+// A unix server is started at /run/docker/plugins/<plugin-name>.sock to enable discovery of this plugin by docker,
+// the name and the socket are set with `--plugin-name` and `--socket`.
 const (
-	socketAddress = "/run/docker/plugins/minfs.sock"
+	defaultPluginName = "minfs"
 
 	defaultLocation = "us-east-1"
 )
@@ -58,21 +62,135 @@ type serverConfig struct {
 	accessKey string
 	// secretKey of the remote Minio server.
 	secretKey string
+	// FUSE client used to mount the bucket, one of the keys of `mounters`.
+	backend string
+	// region in which the bucket is created.
+	region string
+	// name of the server profile the volume was created with (`-o server=`), see profiles.go.
+	server string
+	// TLS settings of the connections to the server, set by the server profile.
+	caFile   string
+	insecure bool
+	// files the keys are read from when they are needed (`-o access-key-file=`, `-o secret-key-file=`),
+	// or the secret holding both of them (`-o credentials=secret:<name>`), see credentials.go.
+	// The keys themselves are left empty for such volumes.
+	accessKeyFile string
+	secretKeyFile string
+	secret        string
+	// provider of the keys of volumes created without them, see providers.go.
+	fromEnv    bool
+	awsProfile string
+	mcAlias    string
+	// temporary credentials of the volume (`-o sts=`), see sts.go.
+	sts         string
+	stsEndpoint string
+	roleARN     string
+	stsDuration time.Duration
+	metadataURL string
+	// session token and expiry of temporary credentials, only set on a config returned by `resolveCredentials`.
+	sessionToken string
+	expiresAt    time.Time
 }
 
 // Represents an instance of `minfs` mount of remote Minio bucket.
 // Its defined by
 //   - The server info for the mount.
 //   - The local mountpoint.
-//   - The number of connections alive for the mount (No.Of.Services still using the mount point).
+//   - The IDs of the containers using the mount (the mount is alive as long as the set isn't empty).
 type mountInfo struct {
 	config     serverConfig
 	mountPoint string
-	// the number of containers using the mount.
-	// an active mount is done when the count is 0.
-	// unmount is done only if the number of connections is 0.
-	// otherwise just the count is decreased.
-	connections int
+	// the IDs passed by docker in `volume.MountRequest` for the containers using the mount.
+	// an active mount is done when the first ID is added.
+	// unmount is done only when the last ID is released.
+	// Docker can repeat a Mount/Unmount call for the same ID, such calls are no-ops.
+	mountIDs set.StringSet
+	// error of the last failed mount, the volume is reported as degraded while it is set.
+	// cleared by the next successful mount.
+	lastError string
+	// time at which the volume was created.
+	createdAt time.Time
+	// time of the last rotation of the credentials.
+	credentialsRotatedAt time.Time
+	// set when the credentials were rotated while the volume was mounted,
+	// the mount uses the old keys until the last container releases it.
+	credentialsPending bool
+	// outcome of the checks of the watchdog while the volume is mounted, see watchdog.go.
+	health volumeHealth
+	// expiry of the temporary credentials last handed to the mount, see sts.go.
+	credentialsExpireAt time.Time
+	// set while `remount` runs the helpers without holding the lock,
+	// no other unmount or mount of the volume is started meanwhile.
+	remounting bool
+}
+
+// return the options of `docker volume create` with the defaults of the driver filled in.
+func (d *minfsDriver) withDefaults(options map[string]string) map[string]string {
+	defaults := map[string]string{
+		"endpoint": d.config.endpoint,
+		"backend":  d.config.backend,
+	}
+	merged := make(map[string]string)
+	for key, value := range options {
+		merged[key] = value
+	}
+	for key, value := range defaults {
+		if merged[key] == "" && value != "" {
+			merged[key] = value
+		}
+	}
+	if len(merged) == 0 {
+		return options
+	}
+	return merged
+}
+
+// mark the volume as degraded after a failed mount.
+func (v *mountInfo) setDegraded(err error) {
+	v.lastError = err.Error()
+}
+
+// return the status of the volume reported to docker by `Get` and `List`, shown by `docker volume inspect`.
+// The credentials are never part of the status, only where they come from, and every field is redacted.
+func (v *mountInfo) status() map[string]interface{} {
+	status := map[string]interface{}{
+		"endpoint": v.config.endpoint,
+		"bucket":   v.config.bucket,
+		"region":   v.config.region,
+		"backend":  v.config.backend,
+		"state":    v.state(),
+		"mountIDs": v.mountIDs.ToSlice(),
+	}
+	if v.config.server != "" {
+		status["server"] = v.config.server
+	}
+	status["credentialsSource"] = v.config.credentialSource()
+	if !v.credentialsExpireAt.IsZero() && !v.mountIDs.IsEmpty() {
+		status["credentialsExpireAt"] = v.credentialsExpireAt.Format(time.RFC3339)
+	}
+	if !v.createdAt.IsZero() {
+		status["createdAt"] = v.createdAt.Format(time.RFC3339)
+	}
+	if v.lastError != "" {
+		status["lastError"] = v.lastError
+	}
+	if !v.credentialsRotatedAt.IsZero() {
+		status["credentialsRotatedAt"] = v.credentialsRotatedAt.Format(time.RFC3339)
+		status["credentialsPending"] = v.credentialsPending
+	}
+	v.health.addTo(status)
+	return redactStatus(status)
+}
+
+// return the state of the volume reported in its status.
+func (v *mountInfo) state() string {
+	switch {
+	case v.lastError != "":
+		return "degraded"
+	case !v.mountIDs.IsEmpty():
+		return "mounted"
+	}
+	return "unmounted"
 }
 
 // minfsDriver - The struct implements the `github.com/docker/go-plugins-helpers/volume.Driver` interface.
@@ -87,11 +205,15 @@ type mountInfo struct {
 // 4. Once registered the implemented methods on `minfsDriver` are called whenever docker
 //    interacts with the plugin via HTTP requests. These methods are resposible for responding to docker with
 //    success or error messages.
+// A failure of a single request (ex: the bucket can't be created, or the mount fails) is returned to docker in
+// `volume.Response.Err` and the volume is marked as degraded, the plugin keeps serving every other volume.
+// Only errors during startup terminate the process.
 type minfsDriver struct {
 	// used for atomic access to the fields.
 	sync.RWMutex
 	mountRoot string
-	// config of the remote Minio server.
+	// defaults for the options missing in `docker volume create`, only `endpoint` and `backend` are used.
+	// Set with `--default-endpoint` and `--default-backend`, ex: by `docker plugin set`.
 	config serverConfig
 	// the local path to which the remote Minio bucket is mounted to.
 
@@ -100,19 +222,53 @@ type minfsDriver struct {
 	// instances or buckets.
 	// The state info of these mounts are maintained here.
 	mounts map[string]*mountInfo
+	// saves `mounts` to disk so that the volumes survive a restart of the plugin.
+	store *stateStore
+	// caches the number of objects and the size of the buckets reported in the status of the volumes,
+	// nil if the usage isn't reported.
+	usage *usageCache
+	// the servers of the config file, indexed by name.
+	profiles map[string]serverProfile
 }
 
 // return a new instance of minfsDriver.
-func newMinfsDriver(mountRoot string) *minfsDriver {
+// The volumes saved in `stateDir` by an earlier run of the plugin are loaded,
+// their credentials are decrypted with the state keys read from `keySource` and `previousKeySource`.
+func newMinfsDriver(mountRoot, stateDir string, keySource, previousKeySource stateKeySource) (*minfsDriver, error) {
 	logrus.WithField("method", "new minfs driver").Debug(mountRoot)
 
+	store, err := newStateStore(stateDir, keySource, previousKeySource)
+	if err != nil {
+		return nil, err
+	}
+	mounts, stale, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"statedir": stateDir,
+		"volumes":  len(mounts),
+	}).Info("Loaded saved volumes.")
+	// credentials in plain text or encrypted with the previous key are encrypted with the current key.
+	if stale {
+		if err = store.save(mounts); err != nil {
+			return nil, fmt.Errorf("Unable to encrypt the saved credentials with the state key. <ERROR> %v", err)
+		}
+		logrus.WithField("key", store.keys.currentID()).Info("Encrypted the saved credentials with the state key.")
+	}
+	if store.keys.current == nil {
+		logrus.Warn("The keys of the volumes are saved in plain text, pass --state-key-file or --state-key-command to encrypt them.")
+	}
+
 	d := &minfsDriver{
 		mountRoot: mountRoot,
 		config:    serverConfig{},
-		mounts:    make(map[string]*mountInfo),
+		mounts:    mounts,
+		profiles:  make(map[string]serverProfile),
+		store:     store,
 	}
 
-	return d
+	return d, nil
 }
 
 // *minfsDriver.Create - This method is called by docker when a volume is created
@@ -126,7 +282,11 @@ func newMinfsDriver(mountRoot string) *minfsDriver {
 // The remote bucket will be mounted at `mountRoot + volumeName`.
 // mountRoot is passed as `--mountroot` flag when starting the plugin server.
 func (d *minfsDriver) Create(r volume.Request) volume.Response {
-	logrus.WithField("method", "Create").Debugf("%#v", r)
+	logrus.WithFields(logrus.Fields{
+		"method":  "Create",
+		"volume":  r.Name,
+		"options": redactOptions(r.Options),
+	}).Debug("Request from docker.")
 	// hold lock for safe access.
 	d.Lock()
 	defer d.Unlock()
@@ -135,18 +295,28 @@ func (d *minfsDriver) Create(r volume.Request) volume.Response {
 	if r.Name == "" {
 		return errorResponse("Name of the driver cannot be empty.Use `$ docker volume create -d <plugin-name> --name <volume-name>`")
 	}
+	// the name of the volume becomes a directory under `mountroot`.
+	if err := validateVolumeName(r.Name); err != nil {
+		return errorResponse(err.Error())
+	}
+	// the settings of the server profile come first, the defaults of the driver fill what is left.
+	options, err := d.expandServer(r.Options)
+	if err != nil {
+		return errorResponse(err.Error())
+	}
+	r.Options = d.withDefaults(options)
 	// if the volume is already created verify that the server configs match.
 	// If not return with error.
 	// Since the plugin system identifies a mount uniquely by its name,
 	// its not possible to create a duplicate volume pointing to a different Minio server or bucket.
 	if mntInfo, ok := d.mounts[r.Name]; ok {
 		// Since the volume by the given name already exists,
-		// match to see whether the endpoint, bucket, accessKey and secretKey of the
+		// match to see whether the endpoint, bucket, accessKey, secretKey and the other options of the
 		// new  request and the existing entry match.
-		// return error on mismatch.
+		// return error listing the conflicting options on mismatch.
 		// else return with success message,
 		// Since the volume already exists no need to proceed further.
-		err := matchServerConfig(mntInfo.config, r)
+		err := matchServerConfig(mntInfo.config, r, d.profiles)
 		if err != nil {
 			return errorResponse(err.Error())
 		}
@@ -164,44 +334,50 @@ func (d *minfsDriver) Create(r volume.Request) volume.Response {
 	if r.Options["bucket"] == "" {
 		return errorResponse("bucket option cannot be empty.")
 	}
-	if r.Options["access-key"] == "" {
-		return errorResponse("access-key option cannot be empty")
+	// the keys are passed inline or refer to files in the secrets directory.
+	if err := validateCredentialOptions(r.Options); err != nil {
+		return errorResponse(err.Error())
+	}
+	if err := validateSTSOptions(r.Options); err != nil {
+		return errorResponse(err.Error())
 	}
-	if r.Options["secret-key"] == "" {
-		return errorResponse("secret-key cannot be empty.")
+	// the endpoint and the bucket are passed as arguments to the mount helper, which runs as root.
+	// Verify them before anything reaches the host.
+	if err := validateEndpoint(r.Options["endpoint"]); err != nil {
+		return errorResponse(err.Error())
 	}
-
-	mntInfo := &mountInfo{}
-	config := serverConfig{}
-
-	// Additional options passed with `-o` option are parsed here.
-	config.endpoint = r.Options["endpoint"]
-	config.bucket = r.Options["bucket"]
-	config.secretKey = r.Options["secret-key"]
-	config.accessKey = r.Options["access-key"]
-
-	// find out whether the scheme of the URL is HTTPS.
-	enableSSL, err := isSSL(config.endpoint)
-	if err != nil {
-		logrus.Error("Please send a valid URL of form http(s)://my-minio.com:9000 <ERROR> ", err.Error())
+	if err := validateBucketName(r.Options["bucket"]); err != nil {
+		return errorResponse(err.Error())
+	}
+	// verify that the FUSE backend is supported, `minfs` is used by default.
+	if _, err := getMounter(r.Options["backend"]); err != nil {
 		return errorResponse(err.Error())
 	}
 
-	minioHost, err := getHost(config.endpoint)
-	if err != nil {
-		logrus.Error("Please send a valid URL of form http(s)://my-minio.com:9000 <ERROR> ", err.Error())
+	mntInfo := &mountInfo{mountIDs: set.NewStringSet()}
+	// Additional options passed with `-o` option are parsed here.
+	config := configFromOptions(r.Options)
+	if config.server != "" {
+		d.profiles[config.server].apply(&config)
+		if err = validateServerTLS(config); err != nil {
+			return errorResponse(err.Error())
+		}
+	}
+	// volumes created without keys get them from the first provider which has them.
+	if err = findCredentialProvider(&config); err != nil {
 		return errorResponse(err.Error())
 	}
+
 	// Verify if the bucket exists.
 	// If it doesnt exist create the bucket on the remote Minio server.
 	// Initialize minio client object.
-	minioClient, err := minio.New(minioHost, config.accessKey, config.secretKey, enableSSL)
+	minioClient, err := newMinioClient(config)
 	if err != nil {
 		logrus.Errorf("Error creating new Minio client. <Error> %s", err.Error())
 		return errorResponse(err.Error())
 	}
 	// Create a bucket.
-	err = minioClient.MakeBucket(config.bucket, defaultLocation)
+	err = minioClient.MakeBucket(config.bucket, config.region)
 	if err != nil {
 		// Check to see if we already own this bucket.
 		exists, eErr := minioClient.BucketExists(config.bucket)
@@ -216,7 +392,7 @@ func (d *minfsDriver) Create(r volume.Request) volume.Response {
 			logrus.WithFields(logrus.Fields{
 				"endpoint": config.endpoint,
 				"bucket":   config.bucket,
-			}).Fatal(err.Error())
+			}).Errorf("Unable to create bucket. <ERROR> %v", err)
 			return errorResponse(err.Error())
 		}
 	}
@@ -231,9 +407,19 @@ func (d *minfsDriver) Create(r volume.Request) volume.Response {
 	// the server config info which is required for the mount later is also passed as an option during create.
 	// This has to be cached for further usage.
 	mntInfo.config = config
+	mntInfo.createdAt = time.Now().UTC()
 	// `r.Name` contains the plugin name passed with `--name` in `$ docker volume create -d <plugin-name> --name <volume-name>`.
 	// Name of the volume uniquely identifies the mount.
 	d.mounts[r.Name] = mntInfo
+	// save the new volume, so that it survives a restart of the plugin.
+	if err = d.store.save(d.mounts); err != nil {
+		delete(d.mounts, r.Name)
+		logrus.WithFields(logrus.Fields{
+			"operation": "Create",
+			"volume":    r.Name,
+		}).Errorf("Unable to save volume state. <ERROR> %v", err)
+		return errorResponse(err.Error())
+	}
 	return volume.Response{}
 }
 
@@ -241,7 +427,10 @@ func (d *minfsDriver) Create(r volume.Request) volume.Response {
 // This request is issued when a user invokes `docker rm -v` to remove volumes associated with a container.
 // Protocol doc: https://docs.docker.com/engine/extend/plugins_volume/#/volumedriverremove
 func (d *minfsDriver) Remove(r volume.Request) volume.Response {
-	logrus.WithField("method", "remove").Debugf("%#v", r)
+	logrus.WithFields(logrus.Fields{
+		"method": "remove",
+		"volume": r.Name,
+	}).Debug("Request from docker.")
 
 	d.Lock()
 	defer d.Unlock()
@@ -257,21 +446,51 @@ func (d *minfsDriver) Remove(r volume.Request) volume.Response {
 		return errorResponse(fmt.Sprintf("volume %s not found", r.Name))
 	}
 	// The volume should be under use by any other containers.
-	// verify if the number of connections is 0.
-	if v.connections == 0 {
-		// if the count of existing connections is 0, delete the entry for the volume.
-		if err := os.RemoveAll(v.mountPoint); err != nil {
+	// verify that no container holds the volume.
+	if v.mountIDs.IsEmpty() {
+		if v.remounting {
+			return errorResponse(fmt.Sprintf("volume %s is being remounted, try again.", r.Name))
+		}
+		// a mount left behind by a failed unmount is still live, deleting inside it would delete the objects of the bucket.
+		mounted, err := isMountPoint(v.mountPoint)
+		if err != nil {
+			return errorResponse(err.Error())
+		}
+		if mounted {
+			logrus.WithFields(logrus.Fields{
+				"operation":  "Remove",
+				"volume":     r.Name,
+				"mountpoint": v.mountPoint,
+			}).Error("Volume is still mounted.")
+			return errorResponse(fmt.Sprintf("volume %s is still mounted at %s, unmount it first.", r.Name, v.mountPoint))
+		}
+		// if no container is using the volume, delete the entry for the volume.
+		// only the empty mountpoint is removed, never its content.
+		if err := os.Remove(v.mountPoint); err != nil && !os.IsNotExist(err) {
 			return errorResponse(err.Error())
 		}
 		// Delete the entry for the mount.
 		delete(d.mounts, r.Name)
+		if d.usage != nil {
+			d.usage.remove(r.Name)
+		}
+		// save the registry without the removed volume.
+		if err := d.store.save(d.mounts); err != nil {
+			d.mounts[r.Name] = v
+			logrus.WithFields(logrus.Fields{
+				"operation": "Remove",
+				"volume":    r.Name,
+			}).Errorf("Unable to save volume state. <ERROR> %v", err)
+			return errorResponse(err.Error())
+		}
 		return volume.Response{}
 	}
 	// volume is being used by one or more containers.
 	// log and return error to docker daemon.
 	logrus.WithFields(logrus.Fields{
-		"volume": r.Name,
-	}).Errorf("Volume is currently used by %d containers. ", v.connections)
+		"volume":   r.Name,
+		"mountIDs": v.mountIDs.ToSlice(),
+	}).Errorf("Volume is currently used by %d containers. ", len(v.mountIDs))
 
 	return errorResponse(fmt.Sprintf("volume %s is currently under use.", r.Name))
 }
@@ -279,7 +498,10 @@ func (d *minfsDriver) Remove(r volume.Request) volume.Response {
 // *minfsDriver.Path - Respond with the path on the host filesystem where the bucket mount has been made available.
 // protocol doc: https://docs.docker.com/engine/extend/plugins_volume/#/volumedriverpath
 func (d *minfsDriver) Path(r volume.Request) volume.Response {
-	logrus.WithField("method", "path").Debugf("%#v", r)
+	logrus.WithFields(logrus.Fields{
+		"method": "path",
+		"volume": r.Name,
+	}).Debug("Request from docker.")
 
 	d.RLock()
 	defer d.RUnlock()
@@ -298,8 +520,9 @@ func (d *minfsDriver) Path(r volume.Request) volume.Response {
 
 // *minfsDriver.Mount - Does mounting of `minfs`.
 // protocol doc: https://docs.docker.com/engine/extend/plugins_volume/#/volumedrivermount
-// If the mount alredy exists just increment the number of connections and return.
+// If the mount alredy exists just add the ID of the container to the holders of the mount and return.
 // Mount is called only when another container shares the created volume.
+// A repeated call for an ID which already holds the mount is a no-op.
 
 // Step 1: Create volume.
 // $ docker volume create -d minfs-plugin \
@@ -315,7 +538,11 @@ func (d *minfsDriver) Path(r volume.Request) volume.Response {
 // in the local path of `mountroot + profile-pic-store`.
 // Note: mountroot passed as --mountroot flag while starting the plugin server.
 func (d *minfsDriver) Mount(r volume.MountRequest) volume.Response {
-	logrus.WithField("method", "mount").Debugf("%#v", r)
+	logrus.WithFields(logrus.Fields{
+		"method": "mount",
+		"volume": r.Name,
+		"id":     r.ID,
+	}).Debug("Request from docker.")
 
 	d.Lock()
 	defer d.Unlock()
@@ -336,28 +563,48 @@ func (d *minfsDriver) Mount(r volume.MountRequest) volume.Response {
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"mountpount": v.mountPoint,
-		}).Fatalf("Error creating directory for the mountpoint. <ERROR> %v.", err)
+		}).Errorf("Error creating directory for the mountpoint. <ERROR> %v.", err)
+		v.setDegraded(err)
 		return errorResponse(err.Error())
 	}
-	// If the mountpoint is already under use just increment the counter of usage and return to docker daemon.
-	if v.connections > 0 {
-		v.connections++
+	// docker repeated the call for a container which already holds the mount.
+	if v.mountIDs.Contains(r.ID) {
+		logrus.WithFields(logrus.Fields{
+			"volume": r.Name,
+			"id":     r.ID,
+		}).Debug("Volume is already mounted for the container.")
+		return volume.Response{Mountpoint: v.mountPoint}
+	}
+	// If the mountpoint is already under use just add the container to the holders and return to docker daemon.
+	if !v.mountIDs.IsEmpty() {
+		v.mountIDs.Add(r.ID)
+		d.saveMountIDs("mount", r.Name)
 		return volume.Response{Mountpoint: v.mountPoint}
 	}
+	// the last container released the volume while it is remounted, `remount` unmounts it once it is done.
+	if v.remounting {
+		return errorResponse(fmt.Sprintf("volume %s is being remounted, try again.", r.Name))
+	}
 
-	// set access-key and secret-key as env variables.
-	os.Setenv("MINFS_ACCESS_KEY", v.config.accessKey)
-	os.Setenv("MINFS_SECRET_KEY", v.config.secretKey)
 	// Mount the remote Minio bucket to the local mountpoint.
-	if err := d.mountVolume(*v); err != nil {
-		logrus.WithFields(logrus.Fields{
+	expiresAt, err := d.mountVolume(*v)
+	if err != nil {
+		withMountOutput(logrus.WithFields(logrus.Fields{
 			"mountpount": v.mountPoint,
 			"endpoint":   v.config.endpoint,
 			"bucket":     v.config.bucket,
-		}).Fatalf("Mount failed: <ERROR> %v", err)
+			"backend":    v.config.backend,
+		}), err).Errorf("Mount failed: <ERROR> %v", err)
 
+		v.setDegraded(err)
 		return errorResponse(err.Error())
 	}
+	v.lastError = ""
+	// the new mount uses the current credentials.
+	v.credentialsPending = false
+	v.credentialsExpireAt = expiresAt
+	v.mountIDs.Add(r.ID)
+	d.saveMountIDs("mount", r.Name)
 	// success.
 	return volume.Response{Mountpoint: v.mountPoint}
 }
@@ -365,8 +612,14 @@ func (d *minfsDriver) Mount(r volume.MountRequest) volume.Response {
 // *minfsDriver.Unmount - unmounts the mount at `mountpoint`.
 // protocol doc: https://docs.docker.com/engine/extend/plugins_volume/#/volumedriverunmount
 // Unmount is called when a container using the mounted volume is stopped.
+// The remote bucket is unmounted when the last container holding it releases it,
+// a call for an ID which doesn't hold the mount is a no-op.
 func (d *minfsDriver) Unmount(r volume.UnmountRequest) volume.Response {
-	logrus.WithField("method", "unmount").Debugf("%#v", r)
+	logrus.WithFields(logrus.Fields{
+		"method": "unmount",
+		"volume": r.Name,
+		"id":     r.ID,
+	}).Debug("Request from docker.")
 
 	d.Lock()
 	defer d.Unlock()
@@ -381,18 +634,37 @@ func (d *minfsDriver) Unmount(r volume.UnmountRequest) volume.Response {
 
 		return errorResponse(fmt.Sprintf("volume %s not found", r.Name))
 	}
+	// docker repeated the call, or the container never held the mount.
+	if !v.mountIDs.Contains(r.ID) {
+		logrus.WithFields(logrus.Fields{
+			"volume": r.Name,
+			"id":     r.ID,
+		}).Debug("Volume is not mounted for the container.")
+		return volume.Response{}
+	}
 	// Unmount is done only if no other containers are using the mounted volume.
-	if v.connections <= 1 {
+	// If the mounted volume is still being used by another container, dont't unmount,
+	// just release the ID and return.
+	// a remount in progress unmounts the new mount itself once it sees no holders left.
+	if len(v.mountIDs) == 1 && !v.remounting {
 		// unmount.
-		if err := d.unmountVolume(v.mountPoint); err != nil {
+		if err := d.unmountVolume(*v); err != nil {
+			withMountOutput(logrus.WithFields(logrus.Fields{
+				"mountpount": v.mountPoint,
+				"endpoint":   v.config.endpoint,
+				"bucket":     v.config.bucket,
+				"backend":    v.config.backend,
+			}), err).Errorf("Unmount failed: <ERROR> %v", err)
 			return errorResponse(err.Error())
 		}
-		v.connections = 0
-	} else {
-		// If the count is > 1, that is if the mounted volume is already being used by
-		// another container, dont't unmount, just decrease the count and return.
-		v.connections--
 	}
+	v.mountIDs.Remove(r.ID)
+	// the next mount picks up rotated credentials, and is checked from scratch.
+	if v.mountIDs.IsEmpty() {
+		v.credentialsPending = false
+		v.health = volumeHealth{}
+	}
+	d.saveMountIDs("unmount", r.Name)
 
 	return volume.Response{}
 }
@@ -400,35 +672,52 @@ func (d *minfsDriver) Unmount(r volume.UnmountRequest) volume.Response {
 // *minfsDriver.Get - Get the mount info.
 // protocol doc: https://docs.docker.com/engine/extend/plugins_volume/#/volumedriverget
 func (d *minfsDriver) Get(r volume.Request) volume.Response {
-	logrus.WithField("method", "get").Debugf("%#v", r)
+	logrus.WithFields(logrus.Fields{
+		"method": "get",
+		"volume": r.Name,
+	}).Debug("Request from docker.")
 
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 	// verify if the mount exists.
 	v, ok := d.mounts[r.Name]
 	if !ok {
 		// mount doesn't exist, return error.
 		logrus.WithFields(logrus.Fields{
-			"operation": "unmount",
+			"operation": "get",
 			"volume":    r.Name,
 		}).Error("Volume not found.")
 		return errorResponse(fmt.Sprintf("volume %s not found", r.Name))
 	}
+	vol := &volume.Volume{Name: r.Name, Mountpoint: v.mountPoint, Status: v.status()}
+	// listing a large bucket takes a while, it is done in the background.
+	if d.usage != nil {
+		if u, ok := d.usage.get(r.Name, v.config); ok {
+			u.addTo(vol.Status)
+		}
+	}
 
-	return volume.Response{Volume: &volume.Volume{Name: r.Name, Mountpoint: v.mountPoint}}
+	return volume.Response{Volume: vol}
 }
 
 // *minfsDriver.List - Get the list of existing volumes.
 // protocol doc: https://docs.docker.com/engine/extend/plugins_volume/#/volumedriverlist
 func (d *minfsDriver) List(r volume.Request) volume.Response {
-	logrus.WithField("method", "list").Debugf("%#v", r)
+	logrus.WithField("method", "list").Debug("Request from docker.")
 
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	var vols []*volume.Volume
 	for name, v := range d.mounts {
-		vols = append(vols, &volume.Volume{Name: name, Mountpoint: v.mountPoint})
+		status := v.status()
+		// only the cached usage is reported, so that listing stays fast.
+		if d.usage != nil {
+			if u, ok := d.usage.cached(name); ok {
+				u.addTo(status)
+			}
+		}
+		vols = append(vols, &volume.Volume{Name: name, Mountpoint: v.mountPoint, Status: status})
 	}
 	return volume.Response{Volumes: vols}
 }
@@ -436,50 +725,148 @@ func (d *minfsDriver) List(r volume.Request) volume.Response {
 // *minfsDriver.Capabilities -  Takes values "local" or "global", more info in protocol doc below.
 // protocol doc: https://docs.docker.com/engine/extend/plugins_volume/#/volumedrivercapabilities
 func (d *minfsDriver) Capabilities(r volume.Request) volume.Response {
-	logrus.WithField("method", "capabilities").Debugf("%#v", r)
+	logrus.WithField("method", "capabilities").Debug("Request from docker.")
 
 	return volume.Response{Capabilities: volume.Capability{Scope: "local"}}
 }
 
-// mounts minfs to the local mountpoint.
-func (d *minfsDriver) mountVolume(v mountInfo) error {
-	// URL for the bucket (ex: https://play.minio.io:9000/mybucket).
-	var bucketPath string
-	if strings.HasSuffix(v.config.endpoint, "/") {
-		bucketPath = v.config.endpoint + v.config.bucket
-	} else {
-		bucketPath = v.config.endpoint + "/" + v.config.bucket
-	}
-	// mount command for minfs.
-	// ex:  mount -t minfs https://play.minio.io:9000/testbucket /testbucket
-	cmd := fmt.Sprintf("mount -t minfs %s %s", bucketPath, v.mountPoint)
-
-	logrus.Debug(cmd)
-	return exec.Command("sh", "-c", cmd).Run()
+// save the volumes after the holders of a mount changed.
+// The IDs are used to rebuild the state of the mounts after a restart,
+// a failure to save them is only logged since the mount operation itself succeeded.
+func (d *minfsDriver) saveMountIDs(operation, name string) {
+	if err := d.store.save(d.mounts); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"operation": operation,
+			"volume":    name,
+		}).Errorf("Unable to save volume state. <ERROR> %v", err)
+	}
 }
 
-// executes `unmount` on the specified volume.
-func (d *minfsDriver) unmountVolume(target string) error {
-	//  Unmount the volume.
-	cmd := fmt.Sprintf("umount %s", target)
-	logrus.Debug(cmd)
-	return exec.Command("sh", "-c", cmd).Run()
+// mounts the remote bucket to the local mountpoint using the backend of the volume.
+// Keys kept in files are read here, so a replaced file is used by the next mount.
+// Returns the expiry of the temporary credentials the mount uses, zero for long-lived keys.
+func (d *minfsDriver) mountVolume(v mountInfo) (time.Time, error) {
+	m, err := getMounter(v.config.backend)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if v.config, err = resolveCredentials(v.config); err != nil {
+		return time.Time{}, err
+	}
+	start := time.Now()
+	err = m.Mount(v)
+	metrics.observeHelper(v.config.backend, "mount", start, err)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return v.config.expiresAt, nil
+}
+
+// unmounts the volume using the backend it was mounted with.
+func (d *minfsDriver) unmountVolume(v mountInfo) error {
+	m, err := getMounter(v.config.backend)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = m.Unmount(v)
+	metrics.observeHelper(v.config.backend, "unmount", start, err)
+	return err
 }
 
 func main() {
+	// every log entry is redacted, see redact.go.
+	logrus.SetFormatter(redactingFormatter{logrus.StandardLogger().Formatter})
+	// without a subcommand (or with flags only) the plugin is served, as before subcommands existed.
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	os.Exit(runCommand(cmd, args))
+}
+
+// serve - Starts the plugin, `minfs serve [flags]`.
+// Returns nil once the plugin was stopped with SIGTERM or SIGINT, or the error which stopped it.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
 	// --mountroot flag defines the root folder where are the volumes are mounted.
 	// If the option is not specified '/tmp' is taken as default mount root.
-	mountRoot := flag.String("mountroot", "/tmp", "root for mouting Minio buckets.")
-	flag.Parse()
+	mountRoot := flags.String("mountroot", "/tmp", "root for mouting Minio buckets.")
+	// --state-dir flag defines the directory in which the created volumes are saved.
+	// The volumes are loaded from here when the plugin restarts.
+	stateDir := flags.String("state-dir", "/var/lib/minfs", "directory for saving the state of the volumes.")
+	// --usage-ttl flag enables reporting the number of objects and the size of the bucket in the status of the volumes.
+	// The bucket is listed again by `docker volume inspect` once the cached usage is older than the TTL.
+	usageTTL := flags.Duration("usage-ttl", 0, "cache duration of the bucket usage in the volume status, 0 disables it.")
+	// --admin-socket flag defines the unix socket of the admin API, an empty value disables it.
+	adminSocket := flags.String("admin-socket", defaultAdminSocket, "unix socket of the admin API, empty disables it.")
+	// --metrics-addr flag enables serving Prometheus metrics on `/metrics` of the address, ex: `:9567`.
+	metricsAddr := flags.String("metrics-addr", "", "address of the Prometheus metrics listener, empty disables it.")
+	// --watchdog-interval flag defines how often the mounted volumes are checked, and remounted if they are broken.
+	watchdogInterval := flags.Duration("watchdog-interval", 30*time.Second, "interval of the health checks of the mounted volumes, 0 disables them.")
+	// --shutdown-timeout flag defines how long the calls in flight are waited for on SIGTERM or SIGINT.
+	shutdownTimeout := flags.Duration("shutdown-timeout", 30*time.Second, "time given to the calls in flight to finish on shutdown.")
+	// --shutdown-unmount flag defines which mounts are unmounted on shutdown, `none`, `idle` (keeps the busy ones) or `all`.
+	shutdownUnmount := flags.String("shutdown-unmount", shutdownUnmountNone, "mounts unmounted on shutdown: none, idle or all.")
+	// --plugin-name flag defines the name used with `docker volume create -d <plugin-name>`,
+	// run several instances with different names and sockets to use different configurations on one host.
+	pluginName := flags.String("plugin-name", defaultPluginName, "name of the plugin, used by docker to find its socket.")
+	// --socket flag overrides the unix socket, /run/docker/plugins/<plugin-name>.sock by default.
+	socket := flags.String("socket", "", "unix socket of the plugin, defaults to /run/docker/plugins/<plugin-name>.sock.")
+	// --tcp-addr flag enables serving docker over TCP as well, ex: `--tcp-addr=0.0.0.0:9800`.
+	// Clients have to authenticate with a certificate signed by `--tls-ca`.
+	tcpAddr := flags.String("tcp-addr", "", "address of the TCP listener for remote docker daemons, empty disables it.")
+	tlsCert := flags.String("tls-cert", "", "certificate of the TCP listener.")
+	tlsKey := flags.String("tls-key", "", "private key of the TCP listener.")
+	tlsCA := flags.String("tls-ca", "", "CA certificate which signed the certificates of the allowed docker daemons.")
+	// --default-endpoint and --default-backend flags are used for volumes created without `-o endpoint=` and `-o backend=`.
+	defaultEndpoint := flags.String("default-endpoint", "", "endpoint of the volumes created without -o endpoint=.")
+	backend := flags.String("default-backend", defaultBackend, "backend of the volumes created without -o backend=.")
+	// --config flag defines the config file with the server profiles used with `-o server=`, it is read again on SIGHUP.
+	configPath := flags.String("config", "", "config file with the server profiles, empty disables them.")
+	// --secrets-dir flag defines the directory of the files of `-o access-key-file=`, `-o secret-key-file=` and `-o credentials=secret:`.
+	secretsDirFlag := flags.String("secrets-dir", defaultSecretsDir, "directory of the credential files of the volumes.")
+	// --state-key-file and --state-key-command flags define the key encrypting the credentials saved in `--state-dir`,
+	// the --state-previous-key-* flags the key they were encrypted with before the key was rotated, see statekey.go.
+	keySource := stateKeySource{fileFlag: "state-key-file", commandFlag: "state-key-command"}
+	flags.StringVar(&keySource.file, keySource.fileFlag, "", "file with the key encrypting the saved credentials, readable by root only.")
+	flags.StringVar(&keySource.command, keySource.commandFlag, "", "command printing the key encrypting the saved credentials.")
+	previousKeySource := stateKeySource{fileFlag: "state-previous-key-file", commandFlag: "state-previous-key-command"}
+	flags.StringVar(&previousKeySource.file, previousKeySource.fileFlag, "", "file with the key the saved credentials were encrypted with before rotating it.")
+	flags.StringVar(&previousKeySource.command, previousKeySource.commandFlag, "", "command printing the key the saved credentials were encrypted with before rotating it.")
+	flags.Parse(args)
+	// flags which aren't on the command line are read from the environment, as set by `docker plugin set`.
+	if err := setFlagsFromEnv(flags); err != nil {
+		logrus.Fatal(err)
+	}
+	if *defaultEndpoint != "" {
+		if err := validateEndpoint(*defaultEndpoint); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	if _, err := getMounter(*backend); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := validateShutdownUnmount(*shutdownUnmount); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := validatePluginName(*pluginName); err != nil {
+		logrus.Fatal(err)
+	}
+	if !filepath.IsAbs(*secretsDirFlag) {
+		logrus.Fatalf("--secrets-dir has to be an absolute path, got \"%s\".", *secretsDirFlag)
+	}
+	secretsDir = filepath.Clean(*secretsDirFlag)
+	socketPath := pluginSocketPath(*pluginName, *socket)
 	// check if the mount root exists.
 	// create if it doesn't exist.
 	err := createDir(*mountRoot)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
-			"mountroot": mountRoot,
-		}).Fatalf("Unable to create mountroot.")
+			"mountroot": *mountRoot,
+		}).Fatalf("Unable to create mountroot. <ERROR> %v", err)
 
-		return
+		return err
 	}
 	// if `export DEBUG=1` is set, debug logs will be printed.
 	debug := os.Getenv("DEBUG")
@@ -488,12 +875,111 @@ func main() {
 	}
 	// Create a new instance MinfsDriver.
 	// The struct implements the `github.com/docker/go-plugins-helpers/volume.Driver` interface.
-	d := newMinfsDriver(*mountRoot)
+	d, err := newMinfsDriver(*mountRoot, *stateDir, keySource, previousKeySource)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"statedir": *stateDir,
+		}).Fatalf("Unable to load saved volumes. <ERROR> %v", err)
+	}
+	if *configPath != "" {
+		profiles, err := loadProfiles(*configPath)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.WithField("servers", len(profiles)).Infof("Loaded the config file %s.", *configPath)
+		d.profiles = profiles
+		// the profiles could have changed while the plugin was stopped.
+		if d.applyProfiles() {
+			if err = d.store.save(d.mounts); err != nil {
+				logrus.Errorf("Unable to save the volumes after loading the config file. <ERROR> %v", err)
+			}
+		}
+	}
+	// SIGHUP reloads the config file.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			if *configPath == "" {
+				logrus.Warn("Received SIGHUP, but no config file is set with --config.")
+				continue
+			}
+			d.reloadProfiles(*configPath)
+		}
+	}()
+	d.config.endpoint = *defaultEndpoint
+	d.config.backend = *backend
+	if *usageTTL > 0 {
+		d.usage = newUsageCache(*usageTTL)
+	}
+	// The plugin could have been restarted while the volumes were mounted,
+	// match the saved volumes against the live mounts before serving docker.
+	if err = d.reconcile(); err != nil {
+		logrus.Errorf("Unable to reconcile the saved volumes with the live mounts. <ERROR> %v", err)
+	}
 	// register it with the `go-plugin-helper`.
 	// `go-plugin-helper` is a tool built to make development of docker plugins easier, visit https://github.com/docker/go-plugins-helpers/.
 	// The registration is done using https://godoc.org/github.com/docker/go-plugins-helpers/volume#NewHandler .
-	h := volume.NewHandler(d)
+	// every call from docker is recorded for the metrics, and drained on shutdown.
+	drv := &instrumentedDriver{d: d}
+	h := volume.NewHandler(drv)
+	// operators manage the volumes through the admin API, kept off the docker plugin socket.
+	if *adminSocket != "" {
+		go func() {
+			logrus.Errorf("Admin API stopped. <ERROR> %v", d.serveAdmin(*adminSocket))
+		}()
+	}
+	if *watchdogInterval > 0 {
+		go d.watch(*watchdogInterval)
+	}
+	go d.refreshCredentials()
+	if *metricsAddr != "" {
+		go func() {
+			logrus.Errorf("Metrics listener stopped. <ERROR> %v", d.serveMetrics(*metricsAddr))
+		}()
+	}
+	// remote docker daemons are served over TCP with TLS, each with its own client certificate, see the Readme.
+	var listeners []net.Listener
+	if *tcpAddr != "" {
+		tlsConfig, err := newTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		tl, err := newTCPListener(*tcpAddr, tlsConfig)
+		if err != nil {
+			logrus.Fatalf("Unable to listen on %s. <ERROR> %v", *tcpAddr, err)
+		}
+		listeners = append(listeners, tl)
+		go func() {
+			logrus.Errorf("TCP listener stopped. <ERROR> %v", h.Serve(tl))
+		}()
+		logrus.Infof("listening on tcp://%s with TLS", *tcpAddr)
+	}
 	// create a server on unix socket.
-	logrus.Infof("listening on %s", socketAddress)
-	logrus.Error(h.ServeUnix(socketAddress, 0))
+	l, err := newPluginListener(socketPath)
+	if err != nil {
+		return err
+	}
+	listeners = append(listeners, l)
+	logrus.Infof("listening on %s", socketPath)
+	// SIGTERM is sent by `docker plugin disable`, systemd and upgrades.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.Serve(l)
+	}()
+
+	select {
+	case err = <-errCh:
+		return err
+	case sig := <-sigCh:
+		logrus.Infof("Received %s, shutting down.", sig)
+		files := []string{socketPath}
+		if *adminSocket != "" {
+			files = append(files, *adminSocket)
+		}
+		shutdown(drv, listeners, files, *shutdownTimeout, *shutdownUnmount)
+		return nil
+	}
 }
@@ -0,0 +1,357 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// Metrics - Served in the Prometheus text format on `--metrics-addr`, ex: `--metrics-addr=:9567`.
+// The counters and histograms are kept in memory from the start of the plugin,
+// the gauges of the volumes are computed from the driver on every scrape.
+const (
+	metricDriverRequests  = "minfs_driver_requests_total"
+	metricDriverDuration  = "minfs_driver_request_duration_seconds"
+	metricHelperDuration  = "minfs_mount_helper_duration_seconds"
+	metricMinioErrors     = "minfs_minio_request_errors_total"
+	metricActiveMounts    = "minfs_active_mounts"
+	metricVolumeMountRefs = "minfs_volume_mount_refs"
+	metricVolumeState     = "minfs_volume_state"
+)
+
+var metricHelp = map[string]string{
+	metricDriverRequests:  "Number of volume driver calls from docker, by method and result.",
+	metricDriverDuration:  "Duration of the volume driver calls from docker, by method and result.",
+	metricHelperDuration:  "Duration of the mount helpers, by backend, operation and result.",
+	metricMinioErrors:     "Number of failed requests to the Minio servers, by endpoint and HTTP status code, expected 404 and 409 answers aren't counted.",
+	metricActiveMounts:    "Number of volumes mounted on the host.",
+	metricVolumeMountRefs: "Number of containers holding the mount of the volume.",
+	metricVolumeState:     "State of the volume, 1 for the current state.",
+}
+
+// upper bounds of the histogram buckets in seconds, mount helpers can take several seconds.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// `histogram` is a Prometheus histogram with cumulative buckets.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range durationBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metricsRegistry - The counters and histograms, indexed by metric name and then by the rendered label set.
+type metricsRegistry struct {
+	sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// the registry of the plugin, recorded into from the driver, the mounters and the Minio clients.
+var metrics = newMetricsRegistry()
+
+// return a new instance of metricsRegistry.
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// add 1 to the counter.
+func (m *metricsRegistry) inc(name string, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][formatLabels(labels...)]++
+}
+
+// add the duration to the histogram.
+func (m *metricsRegistry) observe(name string, d time.Duration, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	key := formatLabels(labels...)
+	h, ok := m.histograms[name][key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.histograms[name][key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// record a call of the driver.
+func (m *metricsRegistry) observeRequest(method string, start time.Time, resp volume.Response) {
+	result := resultLabel(resp.Err == "")
+	m.inc(metricDriverRequests, "method", method, "result", result)
+	m.observe(metricDriverDuration, time.Since(start), "method", method, "result", result)
+}
+
+// record a run of a mount helper.
+func (m *metricsRegistry) observeHelper(backend, operation string, start time.Time, err error) {
+	m.observe(metricHelperDuration, time.Since(start), "backend", backend, "operation", operation, "result", resultLabel(err == nil))
+}
+
+// write the counters and histograms in the Prometheus text format.
+func (m *metricsRegistry) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	var names []string
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(w, name, "counter")
+		var keys []string
+		for labels := range m.counters[name] {
+			keys = append(keys, labels)
+		}
+		sort.Strings(keys)
+		for _, labels := range keys {
+			fmt.Fprintf(w, "%s%s %s\n", name, labels, formatValue(m.counters[name][labels]))
+		}
+	}
+
+	names = nil
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(w, name, "histogram")
+		var keys []string
+		for labels := range m.histograms[name] {
+			keys = append(keys, labels)
+		}
+		sort.Strings(keys)
+		for _, labels := range keys {
+			h := m.histograms[name][labels]
+			for i, le := range durationBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatValue(le)), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatValue(h.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+		}
+	}
+}
+
+// write the gauges of the volumes held by the driver.
+func (d *minfsDriver) writeMetrics(w io.Writer) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var names []string
+	for name := range d.mounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	active := 0
+	refs := new(bytes.Buffer)
+	states := new(bytes.Buffer)
+	for _, name := range names {
+		v := d.mounts[name]
+		if !v.mountIDs.IsEmpty() {
+			active++
+		}
+		fmt.Fprintf(refs, "%s%s %d\n", metricVolumeMountRefs, formatLabels("volume", name), len(v.mountIDs))
+		for _, state := range []string{"mounted", "unmounted", "degraded"} {
+			value := 0
+			if v.state() == state {
+				value = 1
+			}
+			fmt.Fprintf(states, "%s%s %d\n", metricVolumeState, formatLabels("volume", name, "state", state), value)
+		}
+	}
+	writeHeader(w, metricActiveMounts, "gauge")
+	fmt.Fprintf(w, "%s %d\n", metricActiveMounts, active)
+	writeHeader(w, metricVolumeMountRefs, "gauge")
+	w.Write(refs.Bytes())
+	writeHeader(w, metricVolumeState, "gauge")
+	w.Write(states.Bytes())
+}
+
+// serve the metrics on `/metrics` of the address, returns once the listener fails.
+func (d *minfsDriver) serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+		d.writeMetrics(w)
+	})
+	logrus.Infof("metrics listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// instrumentedDriver - Records the result and the duration of every call of the driver,
+// and tracks the calls in flight so that the plugin can drain them on shutdown (see shutdown.go).
+type instrumentedDriver struct {
+	d *minfsDriver
+	// held for reading by every call in flight, taken for writing to drain them.
+	requests sync.RWMutex
+	// set once the plugin is shutting down, later calls are rejected.
+	draining int32
+}
+
+// run a call of the driver, unless the plugin is shutting down.
+func (i *instrumentedDriver) call(method string, fn func() volume.Response) volume.Response {
+	start := time.Now()
+	if atomic.LoadInt32(&i.draining) == 1 {
+		resp := errorResponse("The plugin is shutting down, retry once it is restarted.")
+		metrics.observeRequest(method, start, resp)
+		return resp
+	}
+	i.requests.RLock()
+	defer i.requests.RUnlock()
+
+	resp := fn()
+	metrics.observeRequest(method, start, resp)
+	return resp
+}
+
+func (i *instrumentedDriver) Create(r volume.Request) volume.Response {
+	return i.call("Create", func() volume.Response { return i.d.Create(r) })
+}
+
+func (i *instrumentedDriver) Remove(r volume.Request) volume.Response {
+	return i.call("Remove", func() volume.Response { return i.d.Remove(r) })
+}
+
+func (i *instrumentedDriver) Path(r volume.Request) volume.Response {
+	return i.call("Path", func() volume.Response { return i.d.Path(r) })
+}
+
+func (i *instrumentedDriver) Mount(r volume.MountRequest) volume.Response {
+	return i.call("Mount", func() volume.Response { return i.d.Mount(r) })
+}
+
+func (i *instrumentedDriver) Unmount(r volume.UnmountRequest) volume.Response {
+	return i.call("Unmount", func() volume.Response { return i.d.Unmount(r) })
+}
+
+func (i *instrumentedDriver) Get(r volume.Request) volume.Response {
+	return i.call("Get", func() volume.Response { return i.d.Get(r) })
+}
+
+func (i *instrumentedDriver) List(r volume.Request) volume.Response {
+	return i.call("List", func() volume.Response { return i.d.List(r) })
+}
+
+func (i *instrumentedDriver) Capabilities(r volume.Request) volume.Response {
+	return i.call("Capabilities", func() volume.Response { return i.d.Capabilities(r) })
+}
+
+// metricsTransport - Counts the failed requests of a Minio client, set on every client by `newMinioClient`.
+// Requests which didn't get a response are counted with the code `network`.
+// The client expects 404 and 409 answers, ex: BucketExists and MakeBucket, they aren't failures.
+type metricsTransport struct {
+	endpoint string
+	base     http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		metrics.inc(metricMinioErrors, "endpoint", t.endpoint, "code", "network")
+		return resp, err
+	}
+	if isFailedStatus(resp.StatusCode) {
+		metrics.inc(metricMinioErrors, "endpoint", t.endpoint, "code", strconv.Itoa(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// return true for the status codes of failed Minio requests: 5xx, and 4xx other than 404 and 409.
+func isFailedStatus(code int) bool {
+	if code == http.StatusNotFound || code == http.StatusConflict {
+		return false
+	}
+	return code >= 400
+}
+
+func resultLabel(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "error"
+}
+
+// render label pairs, ex: formatLabels("method", "Mount") returns `{method="Mount"}`.
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], escapeLabel(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// add a label to rendered labels.
+func withLabel(labels, name, value string) string {
+	label := formatLabels(name, value)
+	if labels == "" {
+		return label
+	}
+	return strings.TrimSuffix(labels, "}") + "," + strings.TrimPrefix(label, "{")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, metricHelp[name])
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
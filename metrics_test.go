@@ -0,0 +1,79 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Tests that only the failed requests to the Minio server are counted as errors.
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		code     int
+		expected float64
+	}{
+		{http.StatusOK, 0},
+		{http.StatusNotModified, 0},
+		// StatObject and BucketExists of a missing object or bucket.
+		{http.StatusNotFound, 0},
+		// MakeBucket of an existing bucket.
+		{http.StatusConflict, 0},
+		{http.StatusForbidden, 1},
+		{http.StatusBadRequest, 1},
+		{http.StatusInternalServerError, 1},
+		{http.StatusServiceUnavailable, 1},
+	}
+
+	endpoint := "test-metrics-transport"
+	client := &http.Client{Transport: metricsTransport{endpoint: endpoint, base: http.DefaultTransport}}
+	for i, testCase := range testCases {
+		code := strconv.Itoa(testCase.code)
+		resp, err := client.Get(server.URL + "/?code=" + code)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %v", i+1, err)
+		}
+		resp.Body.Close()
+
+		metrics.Lock()
+		actual := metrics.counters[metricMinioErrors][formatLabels("endpoint", endpoint, "code", code)]
+		metrics.Unlock()
+		if actual != testCase.expected {
+			t.Errorf("Test %d: Expected %v errors for status %s, got %v", i+1, testCase.expected, code, actual)
+		}
+	}
+
+	// requests which didn't get a response.
+	server.Close()
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatalf("Expected an error from a closed server.")
+	}
+	metrics.Lock()
+	actual := metrics.counters[metricMinioErrors][formatLabels("endpoint", endpoint, "code", "network")]
+	metrics.Unlock()
+	if actual != 1 {
+		t.Errorf("Expected 1 network error, got %v", actual)
+	}
+}
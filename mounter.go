@@ -0,0 +1,263 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// backend used when a volume is created without `-o backend=`.
+const defaultBackend = "minfs"
+
+// Mounter - A FUSE client which mounts the remote bucket of a volume at its local mountpoint.
+// The backend is selected per volume while creating it,
+// $ docker volume create -d minfs --name <volume-name> -o backend=<minfs|s3fs|goofys|rclone|builtin|noop> ...
+// Each backend builds its own command and environment, and knows how to verify its mount.
+// Credentials are handed to the FUSE client only through the environment of its own command.
+type Mounter interface {
+	// mount the remote bucket at `v.mountPoint`.
+	Mount(v mountInfo) error
+	// unmount the bucket mounted at `v.mountPoint`.
+	Unmount(v mountInfo) error
+	// verify that the mount at `v.mountPoint` is alive and serving the bucket.
+	Check(v mountInfo) error
+}
+
+// The supported backends, indexed by the value of `-o backend=`.
+var mounters = map[string]Mounter{
+	"minfs":  minfsMounter{},
+	"s3fs":   s3fsMounter{},
+	"goofys": goofysMounter{},
+	"rclone": rcloneMounter{},
+	"noop":   noopMounter{},
+	// serves the filesystem from within the plugin, see fusefs.go.
+	"builtin": newBuiltinMounter(),
+}
+
+// return the Mounter for the backend, `minfs` is used when no backend is set.
+func getMounter(backend string) (Mounter, error) {
+	if backend == "" {
+		backend = defaultBackend
+	}
+	m, ok := mounters[backend]
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend \"%s\", supported backends are %s.", backend, strings.Join(mounterNames(), ", "))
+	}
+	return m, nil
+}
+
+// return the names of the supported backends in sorted order.
+func mounterNames() []string {
+	var names []string
+	for name := range mounters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// `minfsMounter` mounts the bucket using the `minfs` FUSE client (https://github.com/minio/minfs).
+type minfsMounter struct{}
+
+func (minfsMounter) Mount(v mountInfo) error {
+	// mount command for minfs.
+	// ex:  mount -t minfs https://play.minio.io:9000/testbucket /testbucket
+	cmd := []string{"mount", "-t", "minfs", bucketURL(v.config), v.mountPoint}
+	env := map[string]string{
+		"MINFS_ACCESS_KEY": v.config.accessKey,
+		"MINFS_SECRET_KEY": v.config.secretKey,
+	}
+	return runMountCommand(cmd, env)
+}
+
+func (minfsMounter) Unmount(v mountInfo) error {
+	return fuseUnmount(v.mountPoint)
+}
+
+func (minfsMounter) Check(v mountInfo) error {
+	return checkFuseMount(v.mountPoint)
+}
+
+// `s3fsMounter` mounts the bucket using `s3fs-fuse` (https://github.com/s3fs-fuse/s3fs-fuse).
+type s3fsMounter struct{}
+
+func (s3fsMounter) Mount(v mountInfo) error {
+	// path style requests are needed for Minio servers which aren't configured with a domain.
+	// ex: s3fs testbucket /testbucket -o url=https://play.minio.io:9000 -o use_path_request_style
+	cmd := []string{"s3fs", v.config.bucket, v.mountPoint,
+		"-o", "url=" + strings.TrimSuffix(v.config.endpoint, "/"), "-o", "use_path_request_style"}
+	env := map[string]string{
+		"AWSACCESSKEYID":     v.config.accessKey,
+		"AWSSECRETACCESSKEY": v.config.secretKey,
+	}
+	return runMountCommand(cmd, env)
+}
+
+func (s3fsMounter) Unmount(v mountInfo) error {
+	return fuseUnmount(v.mountPoint)
+}
+
+func (s3fsMounter) Check(v mountInfo) error {
+	return checkFuseMount(v.mountPoint)
+}
+
+// `goofysMounter` mounts the bucket using `goofys` (https://github.com/kahing/goofys).
+type goofysMounter struct{}
+
+func (goofysMounter) Mount(v mountInfo) error {
+	// ex: goofys --endpoint https://play.minio.io:9000 testbucket /testbucket
+	cmd := []string{"goofys", "--endpoint", strings.TrimSuffix(v.config.endpoint, "/"), v.config.bucket, v.mountPoint}
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":     v.config.accessKey,
+		"AWS_SECRET_ACCESS_KEY": v.config.secretKey,
+	}
+	return runMountCommand(cmd, env)
+}
+
+func (goofysMounter) Unmount(v mountInfo) error {
+	return fuseUnmount(v.mountPoint)
+}
+
+func (goofysMounter) Check(v mountInfo) error {
+	return checkFuseMount(v.mountPoint)
+}
+
+// `rcloneMounter` mounts the bucket using `rclone mount` (https://rclone.org/commands/rclone_mount/).
+// The S3 remote is configured entirely through the environment, no rclone config file is needed.
+type rcloneMounter struct{}
+
+func (rcloneMounter) Mount(v mountInfo) error {
+	// ex: rclone mount --daemon :s3:testbucket /testbucket
+	cmd := []string{"rclone", "mount", "--daemon", ":s3:" + v.config.bucket, v.mountPoint}
+	env := map[string]string{
+		"RCLONE_S3_PROVIDER":          "Minio",
+		"RCLONE_S3_ENDPOINT":          strings.TrimSuffix(v.config.endpoint, "/"),
+		"RCLONE_S3_ACCESS_KEY_ID":     v.config.accessKey,
+		"RCLONE_S3_SECRET_ACCESS_KEY": v.config.secretKey,
+	}
+	return runMountCommand(cmd, env)
+}
+
+func (rcloneMounter) Unmount(v mountInfo) error {
+	return fuseUnmount(v.mountPoint)
+}
+
+func (rcloneMounter) Check(v mountInfo) error {
+	return checkFuseMount(v.mountPoint)
+}
+
+// `noopMounter` doesn't mount anything, the volume is a plain local directory at the mountpoint.
+// Used for local development on machines without FUSE.
+type noopMounter struct{}
+
+func (noopMounter) Mount(v mountInfo) error {
+	logrus.WithFields(logrus.Fields{
+		"mountpoint": v.mountPoint,
+		"bucket":     v.config.bucket,
+	}).Debug("noop backend, the bucket is not mounted.")
+	return nil
+}
+
+func (noopMounter) Unmount(v mountInfo) error {
+	return nil
+}
+
+func (noopMounter) Check(v mountInfo) error {
+	_, err := os.Stat(v.mountPoint)
+	return err
+}
+
+// URL for the bucket (ex: https://play.minio.io:9000/mybucket).
+func bucketURL(config serverConfig) string {
+	if strings.HasSuffix(config.endpoint, "/") {
+		return config.endpoint + config.bucket
+	}
+	return config.endpoint + "/" + config.bucket
+}
+
+// run the mount command of a backend with the environment it needs.
+// The credentials are only passed in the environment of this single command,
+// they are never set on the plugin process, where they would leak into every later
+// child process and race with concurrent mounts of other volumes.
+// The command is executed directly with its argument vector, never through a shell,
+// so that endpoints, buckets and paths are never interpreted as shell syntax.
+func runMountCommand(args []string, env map[string]string) error {
+	logrus.Debug(strings.Join(args, " "))
+	c := exec.Command(args[0], args[1:]...)
+	c.Env = commandEnv(env)
+	// the output is kept to tell the user why the mount failed.
+	if output, err := c.CombinedOutput(); err != nil {
+		return newMountError(args[0], err, output)
+	}
+	return nil
+}
+
+// return the environment of the plugin process extended with `env`.
+// The values of `env` take precedence over variables of the same name.
+func commandEnv(env map[string]string) []string {
+	var keys []string
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var cmdEnv []string
+	for _, kv := range os.Environ() {
+		if _, ok := env[strings.SplitN(kv, "=", 2)[0]]; ok {
+			continue
+		}
+		cmdEnv = append(cmdEnv, kv)
+	}
+	for _, key := range keys {
+		cmdEnv = append(cmdEnv, key+"="+env[key])
+	}
+	return cmdEnv
+}
+
+// executes `umount` on the mountpoint of a FUSE backend.
+func fuseUnmount(target string) error {
+	logrus.Debug("umount " + target)
+	if output, err := exec.Command("umount", target).CombinedOutput(); err != nil {
+		return newMountError("umount", err, output)
+	}
+	return nil
+}
+
+// verifies that the mountpoint is listed as a FUSE mount and that its FUSE process is alive.
+func checkFuseMount(mountPoint string) error {
+	mounted, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return err
+	}
+	entry, ok := mounted[mountPoint]
+	if !ok {
+		return fmt.Errorf("%s is not mounted", mountPoint)
+	}
+	if !strings.HasPrefix(entry.fsType, "fuse") {
+		return fmt.Errorf("%s is mounted with file system type \"%s\", not a FUSE mount", mountPoint, entry.fsType)
+	}
+	if isStaleMount(mountPoint) {
+		return fmt.Errorf("%s is stale, transport endpoint is not connected", mountPoint)
+	}
+	return nil
+}
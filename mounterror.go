@@ -0,0 +1,144 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// mountErrorKind - The class of a failed mount, used to tell the user what to fix.
+type mountErrorKind int
+
+const (
+	// the output didn't match any known failure.
+	mountErrUnknown mountErrorKind = iota
+	// the FUSE client (or the mount helper for its file system type) isn't installed.
+	mountErrMissingBinary
+	// /dev/fuse is missing or the plugin isn't allowed to use it.
+	mountErrFuseUnavailable
+	// the server rejected the access-key or the secret-key.
+	mountErrAuthRejected
+	// the endpoint couldn't be resolved or reached, or its TLS certificate wasn't accepted.
+	mountErrNetwork
+	// the bucket doesn't exist on the server.
+	mountErrBucketNotFound
+)
+
+// Substrings of the helper output (matched lower cased) for each class of failure.
+// The checks are done in order, the first match wins.
+var mountErrorPatterns = []struct {
+	kind     mountErrorKind
+	patterns []string
+}{
+	{mountErrMissingBinary, []string{
+		"executable file not found", "unknown filesystem type", "helper program", "command not found",
+	}},
+	{mountErrFuseUnavailable, []string{
+		"/dev/fuse", "fuse: device not found", "fuse device not found", "modprobe fuse", "fusermount: mount failed: operation not permitted",
+	}},
+	{mountErrBucketNotFound, []string{
+		"nosuchbucket", "bucket does not exist", "specified bucket does not exist", "bucket not found",
+	}},
+	{mountErrAuthRejected, []string{
+		"accessdenied", "access denied", "invalidaccesskeyid", "signaturedoesnotmatch", "403 forbidden", "authentication",
+	}},
+	{mountErrNetwork, []string{
+		"no such host", "x509:", "certificate", "tls:", "connection refused", "i/o timeout", "network is unreachable",
+		"temporary failure in name resolution",
+	}},
+}
+
+// mountError - Failure of a mount or unmount, along with the full output of the helper.
+// `Error` is the short actionable message returned to docker, `output` is logged.
+type mountError struct {
+	kind mountErrorKind
+	// name of the helper which failed, ex: `mount`, `s3fs`.
+	helper string
+	// combined stdout and stderr of the helper.
+	output string
+	// the error returned while running the helper.
+	err error
+}
+
+func (e *mountError) Error() string {
+	msg := fmt.Sprintf("%s failed: %s", e.helper, e.kind.hint())
+	// the last line of the output is usually the reason reported by the helper.
+	if line := lastLine(e.output); line != "" {
+		return fmt.Sprintf("%s (%s)", msg, line)
+	}
+	return fmt.Sprintf("%s (%v)", msg, e.err)
+}
+
+// what the user should check for each class of failure.
+func (k mountErrorKind) hint() string {
+	switch k {
+	case mountErrMissingBinary:
+		return "the FUSE client of the backend is not installed on the host, install it or pick another backend with -o backend="
+	case mountErrFuseUnavailable:
+		return "FUSE is not available, verify that the fuse module is loaded and /dev/fuse is accessible to the plugin"
+	case mountErrAuthRejected:
+		return "the server rejected the credentials, verify access-key and secret-key"
+	case mountErrNetwork:
+		return "the endpoint could not be reached, verify the endpoint URL, DNS and the TLS certificate of the server"
+	case mountErrBucketNotFound:
+		return "the bucket does not exist on the server"
+	}
+	return "unexpected error"
+}
+
+// classify the failure of a helper from its error and output.
+func newMountError(helper string, err error, output []byte) *mountError {
+	e := &mountError{
+		kind:   mountErrUnknown,
+		helper: helper,
+		output: strings.TrimSpace(string(output)),
+		err:    err,
+	}
+	if eErr, ok := err.(*exec.Error); ok && eErr.Err == exec.ErrNotFound {
+		e.kind = mountErrMissingBinary
+		return e
+	}
+
+	text := strings.ToLower(e.output + "\n" + err.Error())
+	for _, p := range mountErrorPatterns {
+		for _, pattern := range p.patterns {
+			if strings.Contains(text, pattern) {
+				e.kind = p.kind
+				return e
+			}
+		}
+	}
+	return e
+}
+
+// return the last non empty line of the output.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// add the full output of the helper to the log entry, if the error carries it.
+func withMountOutput(log *logrus.Entry, err error) *logrus.Entry {
+	if mErr, ok := err.(*mountError); ok && mErr.output != "" {
+		return log.WithField("output", mErr.output)
+	}
+	return log
+}
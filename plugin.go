@@ -0,0 +1,63 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Managed plugin - `docker plugin install` starts the driver from plugin/config.json, where the settings
+// can only be passed in the environment (`docker plugin set minfs MINFS_MOUNTROOT=...`).
+// Every flag of `minfs serve` is also read from the variable named after it with the `MINFS_` prefix,
+// upper cased with `_` for `-`, ex: `--state-dir` from MINFS_STATE_DIR. The prefix keeps unrelated
+// variables of the host, ex: CONFIG, away from the flags. Flags on the command line win over the environment.
+
+// prefix of the environment variables of the flags.
+const flagEnvPrefix = "MINFS_"
+
+// return the name of the environment variable of a flag.
+func flagEnvName(name string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// set the flags which weren't passed on the command line from their environment variables.
+func setFlagsFromEnv(flags *flag.FlagSet) error {
+	passed := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		passed[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if passed[f.Name] || err != nil {
+			return
+		}
+		env := flagEnvName(f.Name)
+		// a variable set to an empty value clears the flag, ex: MINFS_ADMIN_SOCKET= disables the admin API.
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		if sErr := flags.Set(f.Name, value); sErr != nil {
+			err = fmt.Errorf("Invalid value \"%s\" of %s. <ERROR> %v", value, env, sErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,39 @@
+#!/bin/sh
+#
+# Minio Cloud Storage, (C) 2017 Minio, Inc.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+
+# Builds the managed plugin and creates it in the local docker,
+# $ ./plugin/build.sh [plugin-name]
+# Push it with `docker plugin push <plugin-name>`.
+
+set -e
+
+PLUGIN_NAME=${1:-minfs}
+ROOT=$(cd "$(dirname "$0")/.." && pwd)
+BUILD="$ROOT/plugin/build"
+
+docker build -f "$ROOT/plugin/Dockerfile" -t minfs-plugin-rootfs "$ROOT"
+
+rm -rf "$BUILD"
+mkdir -p "$BUILD/rootfs"
+id=$(docker create minfs-plugin-rootfs true)
+docker export "$id" | tar -x -C "$BUILD/rootfs"
+docker rm -vf "$id" > /dev/null
+cp "$ROOT/plugin/config.json" "$BUILD/config.json"
+
+docker plugin rm -f "$PLUGIN_NAME" 2> /dev/null || true
+docker plugin create "$PLUGIN_NAME" "$BUILD"
+echo "Created plugin $PLUGIN_NAME, enable it with: docker plugin enable $PLUGIN_NAME"
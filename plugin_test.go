@@ -0,0 +1,77 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+)
+
+// Tests reading the flags of `minfs serve` from the environment.
+func TestSetFlagsFromEnv(t *testing.T) {
+	env := map[string]string{
+		"MINFS_STATE_DIR":    "/var/lib/minfs-test",
+		"MINFS_ADMIN_SOCKET": "",
+		"MINFS_MOUNTROOT":    "/mnt/env",
+		// variables without the prefix belong to someone else.
+		"CONFIG": "/etc/unrelated.toml",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	stateDir := flags.String("state-dir", "/var/lib/minfs", "")
+	adminSocket := flags.String("admin-socket", defaultAdminSocket, "")
+	mountRoot := flags.String("mountroot", "/tmp", "")
+	configPath := flags.String("config", "", "")
+	interval := flags.Duration("watchdog-interval", 30*time.Second, "")
+	if err := flags.Parse([]string{"--mountroot", "/mnt/flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlagsFromEnv(flags); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{"state-dir", *stateDir, "/var/lib/minfs-test"},
+		// an empty value clears the flag.
+		{"admin-socket", *adminSocket, ""},
+		// the command line wins.
+		{"mountroot", *mountRoot, "/mnt/flag"},
+		{"config", *configPath, ""},
+		{"watchdog-interval", interval.String(), "30s"},
+	}
+	for i, testCase := range testCases {
+		if testCase.actual != testCase.expected {
+			t.Errorf("Test %d: Expected --%s \"%s\", got \"%s\"", i+1, testCase.name, testCase.expected, testCase.actual)
+		}
+	}
+
+	os.Setenv("MINFS_WATCHDOG_INTERVAL", "")
+	defer os.Unsetenv("MINFS_WATCHDOG_INTERVAL")
+	if err := setFlagsFromEnv(flags); err == nil {
+		t.Errorf("Expected an error for an empty duration.")
+	}
+}
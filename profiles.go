@@ -0,0 +1,340 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Sirupsen/logrus"
+)
+
+// Server profiles - Named Minio servers defined in the config file (`--config`), so that volumes are created with
+// $ docker volume create -d minfs --name <volume-name> -o server=prod-minio -o bucket=<bucket>
+// instead of passing the endpoint and the keys to every `docker volume create`.
+// The file is read again on SIGHUP, volumes created from a profile follow its changes.
+// ex: /etc/minfs/config.toml
+// [servers.prod-minio]
+// endpoint = "https://minio.example.com:9000"
+// access-key = "..."
+// secret-key = "..."
+// region = "us-east-1"
+// [servers.prod-minio.tls]
+// ca-file = "/etc/minfs/prod-ca.pem"
+// [servers.prod-minio.options]
+// backend = "builtin"
+// The TLS settings reach the requests of the driver and the builtin backend only,
+// the FUSE clients of the other backends verify the server on their own.
+
+// `serverProfile` is a server of the config file.
+type serverProfile struct {
+	Endpoint  string `toml:"endpoint"`
+	AccessKey string `toml:"access-key"`
+	SecretKey string `toml:"secret-key"`
+	Region    string `toml:"region"`
+	TLS       struct {
+		// CA certificate of the server, for servers with a private CA.
+		CAFile string `toml:"ca-file"`
+		// skip the verification of the certificate of the server, only for testing.
+		InsecureSkipVerify bool `toml:"insecure-skip-verify"`
+	} `toml:"tls"`
+	// default `-o` options of the volumes created with the profile, ex: backend.
+	Options map[string]string `toml:"options"`
+}
+
+// `configFile` is the content of the config file.
+type configFile struct {
+	Servers map[string]serverProfile `toml:"servers"`
+}
+
+// options which are set by the profile, they can't be passed along with `-o server=`.
+var profileOptions = []string{"endpoint", "access-key", "secret-key", "access-key-file", "secret-key-file", "credentials", "profile", "alias"}
+
+// read and verify the server profiles of the config file.
+func loadProfiles(path string) (map[string]serverProfile, error) {
+	var cf configFile
+	md, err := toml.DecodeFile(path, &cf)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the config file %s. <ERROR> %v", path, err)
+	}
+	// a misspelled key would silently drop a setting.
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return nil, fmt.Errorf("Unknown keys in the config file %s: %s.", path, strings.Join(keys, ", "))
+	}
+	// the file holds the keys of the servers.
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0077 != 0 {
+		logrus.Warnf("The config file %s is accessible to other users than its owner, restrict it with `chmod 600`.", path)
+	}
+
+	for name, p := range cf.Servers {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid server \"%s\" in the config file %s. <ERROR> %v", name, path, err)
+		}
+	}
+	if cf.Servers == nil {
+		cf.Servers = make(map[string]serverProfile)
+	}
+	return cf.Servers, nil
+}
+
+// verify the settings of the profile.
+func (p serverProfile) validate() error {
+	if err := validateEndpoint(p.Endpoint); err != nil {
+		return err
+	}
+	if p.AccessKey == "" || p.SecretKey == "" {
+		return fmt.Errorf("access-key and secret-key cannot be empty.")
+	}
+	if p.TLS.CAFile != "" {
+		if _, err := loadCAFile(p.TLS.CAFile); err != nil {
+			return err
+		}
+	}
+	for _, key := range append(profileOptions, "server") {
+		if _, ok := p.Options[key]; ok {
+			return fmt.Errorf("%s cannot be set in the options of a server.", key)
+		}
+	}
+	if backend, ok := p.Options["backend"]; ok {
+		if _, err := getMounter(backend); err != nil {
+			return err
+		}
+		if err := validateServerTLS(serverConfig{caFile: p.TLS.CAFile, insecure: p.TLS.InsecureSkipVerify, backend: backend}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify that the backend of the volume uses the TLS settings of its server.
+func validateServerTLS(config serverConfig) error {
+	if (config.caFile == "" && !config.insecure) || config.backend == "builtin" {
+		return nil
+	}
+	return fmt.Errorf("ca-file and insecure-skip-verify are only supported by the builtin backend, not by %s.", config.backend)
+}
+
+// set the server settings of the profile on the config of a volume.
+func (p serverProfile) apply(config *serverConfig) {
+	config.endpoint = p.Endpoint
+	config.accessKey = p.AccessKey
+	config.secretKey = p.SecretKey
+	config.caFile = p.TLS.CAFile
+	config.insecure = p.TLS.InsecureSkipVerify
+	config.registerSecrets()
+}
+
+// return the options of `docker volume create` with the settings of the server profile named by `-o server=`.
+// The options of the profile are used for the options missing in the request.
+func (d *minfsDriver) expandServer(options map[string]string) (map[string]string, error) {
+	name := options["server"]
+	if name == "" {
+		return options, nil
+	}
+	p, ok := d.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown server \"%s\", the servers are %s.", name, strings.Join(d.profileNames(), ", "))
+	}
+	for _, key := range profileOptions {
+		if options[key] != "" {
+			return nil, fmt.Errorf("%s cannot be combined with server=, it is set by the server profile.", key)
+		}
+	}
+
+	expanded := map[string]string{
+		"endpoint":   p.Endpoint,
+		"access-key": p.AccessKey,
+		"secret-key": p.SecretKey,
+	}
+	if p.Region != "" {
+		expanded["region"] = p.Region
+	}
+	for key, value := range p.Options {
+		expanded[key] = value
+	}
+	for key, value := range options {
+		if value != "" {
+			expanded[key] = value
+		}
+	}
+	return expanded, nil
+}
+
+// return the names of the server profiles in sorted order.
+func (d *minfsDriver) profileNames() []string {
+	var names []string
+	for name := range d.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfiles - Updates the volumes created from a profile with the current endpoint, keys and TLS settings of the profile,
+// the lock has to be held. The region and the options of the profile only apply when a volume is created,
+// they could have been overridden with `-o`.
+// Volumes in use keep the settings they were mounted with until they are mounted again,
+// they are marked as pending like after a rotation of their credentials.
+// Returns whether any volume changed.
+func (d *minfsDriver) applyProfiles() bool {
+	changed := false
+	for name, v := range d.mounts {
+		if v.config.server == "" {
+			continue
+		}
+		log := logrus.WithFields(logrus.Fields{
+			"volume": name,
+			"server": v.config.server,
+		})
+		p, ok := d.profiles[v.config.server]
+		if !ok {
+			log.Warn("The server of the volume is no longer in the config file, the volume keeps its last settings.")
+			continue
+		}
+		config := v.config
+		p.apply(&config)
+		if config == v.config {
+			continue
+		}
+		if err := validateServerTLS(config); err != nil {
+			log.Warnf("The volume keeps its last settings. <ERROR> %v", err)
+			continue
+		}
+		v.config = config
+		v.credentialsRotatedAt = time.Now().UTC()
+		changed = true
+		if !v.mountIDs.IsEmpty() {
+			v.credentialsPending = true
+		}
+		log.WithField("pending", v.credentialsPending).Info("Applied the changed server settings.")
+	}
+	return changed
+}
+
+// reloadProfiles - Reads the config file again after SIGHUP.
+// The profiles are only replaced if the whole file is valid, a broken file keeps the current ones.
+func (d *minfsDriver) reloadProfiles(path string) {
+	profiles, err := loadProfiles(path)
+	if err != nil {
+		logrus.Errorf("Keeping the current server profiles. <ERROR> %v", err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.profiles = profiles
+	// the CA files may have changed along with the config file.
+	serverTransports.reset()
+	resetSTSClients()
+	if d.applyProfiles() {
+		if err := d.store.save(d.mounts); err != nil {
+			logrus.Errorf("Unable to save the volumes after reloading the config file. <ERROR> %v", err)
+		}
+	}
+	logrus.WithField("servers", len(profiles)).Infof("Reloaded the config file %s.", path)
+}
+
+// read the PEM certificates of a CA file.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificate found in the CA file %s.", path)
+	}
+	return pool, nil
+}
+
+// return the TLS config for the connections to the server of the volume, nil for the defaults.
+func serverTLSConfig(config serverConfig) (*tls.Config, error) {
+	if config.caFile == "" && !config.insecure {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.insecure}
+	if config.caFile != "" {
+		pool, err := loadCAFile(config.caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// idle connections to the servers with custom TLS settings are closed after this delay.
+const serverIdleConnTimeout = 90 * time.Second
+
+// transportCache - The transports of the servers with custom TLS settings, one per CA file and
+// `insecure-skip-verify`. The Minio clients are short lived, sharing the transports keeps their
+// idle connections from piling up.
+type transportCache struct {
+	sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// the transports of the Minio clients, see newMinioClient.
+var serverTransports = &transportCache{transports: make(map[string]*http.Transport)}
+
+// return the transport for the TLS settings of the server, nil for the default transport.
+func (c *transportCache) get(config serverConfig) (*http.Transport, error) {
+	if config.caFile == "" && !config.insecure {
+		return nil, nil
+	}
+	key := fmt.Sprintf("%s:%t", config.caFile, config.insecure)
+
+	c.Lock()
+	defer c.Unlock()
+	if transport, ok := c.transports[key]; ok {
+		return transport, nil
+	}
+	tlsConfig, err := serverTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: serverIdleConnTimeout,
+	}
+	c.transports[key] = transport
+	return transport, nil
+}
+
+// drop the transports, the clients still using them keep them until they are done.
+func (c *transportCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	for key, transport := range c.transports {
+		transport.CloseIdleConnections()
+		delete(c.transports, key)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credential providers - Volumes created without keys get them from the first provider of the chain which has them,
+// 1. the options of `docker volume create` (`-o access-key=`, the credential files, `-o server=`),
+// 2. the environment of the plugin, MINIO_ACCESS_KEY/MINIO_SECRET_KEY or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY,
+// 3. the AWS shared credentials file, the profile `-o profile=`, AWS_PROFILE or `default`,
+// 4. the Minio client config, the alias `-o alias=` or the alias whose URL is the endpoint of the volume.
+// `-o profile=` and `-o alias=` are options themselves, they skip the environment.
+// The provider is chosen when the volume is created and saved with it, the keys are read from it at every mount.
+
+const (
+	// the environment is checked in this order.
+	minioAccessKeyEnv = "MINIO_ACCESS_KEY"
+	minioSecretKeyEnv = "MINIO_SECRET_KEY"
+	awsAccessKeyEnv   = "AWS_ACCESS_KEY_ID"
+	awsSecretKeyEnv   = "AWS_SECRET_ACCESS_KEY"
+
+	// profile of the AWS shared credentials file used without `-o profile=` and AWS_PROFILE.
+	defaultAWSProfile = "default"
+)
+
+// `mcConfig` is the part of the config of the Minio client (`mc`) holding the aliases,
+// `hosts` up to version 9 and `aliases` since version 10.
+type mcConfig struct {
+	Hosts   map[string]mcAlias `json:"hosts"`
+	Aliases map[string]mcAlias `json:"aliases"`
+}
+
+type mcAlias struct {
+	URL       string `json:"url"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+// return the keys from the environment, and the variable they were read from.
+func envCredentials() (accessKey, secretKey, source string, err error) {
+	for _, vars := range [][2]string{{minioAccessKeyEnv, minioSecretKeyEnv}, {awsAccessKeyEnv, awsSecretKeyEnv}} {
+		accessKey, secretKey = os.Getenv(vars[0]), os.Getenv(vars[1])
+		if accessKey == "" && secretKey == "" {
+			continue
+		}
+		if accessKey == "" || secretKey == "" {
+			return "", "", "", fmt.Errorf("Both %s and %s have to be set in the environment of the plugin.", vars[0], vars[1])
+		}
+		return accessKey, secretKey, vars[0], nil
+	}
+	return "", "", "", fmt.Errorf("No keys in the environment of the plugin.")
+}
+
+// return the path of the AWS shared credentials file, AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.
+func awsCredentialsPath() string {
+	if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), ".aws", "credentials")
+}
+
+// read the keys of a profile of the AWS shared credentials file.
+// ex: ~/.aws/credentials
+// [default]
+// aws_access_key_id = ...
+// aws_secret_access_key = ...
+func readAWSProfile(profile string) (accessKey, secretKey string, err error) {
+	path := awsCredentialsPath()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to read the AWS credentials file. <ERROR> %v", err)
+	}
+	defer f.Close()
+
+	found := false
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == profile {
+				found = true
+			}
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			accessKey = strings.TrimSpace(kv[1])
+		case "aws_secret_access_key":
+			secretKey = strings.TrimSpace(kv[1])
+		case "aws_session_token":
+			return "", "", fmt.Errorf("The profile %s of %s has a session token, temporary credentials aren't supported.", profile, path)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", "", fmt.Errorf("Unable to read the AWS credentials file. <ERROR> %v", err)
+	}
+	if !found {
+		return "", "", fmt.Errorf("No profile %s in %s.", profile, path)
+	}
+	if accessKey == "" || secretKey == "" {
+		return "", "", fmt.Errorf("The profile %s of %s has to define aws_access_key_id and aws_secret_access_key.", profile, path)
+	}
+	return accessKey, secretKey, nil
+}
+
+// return the path of the config of the Minio client, MC_CONFIG_DIR/config.json or ~/.mc/config.json.
+func mcConfigPath() string {
+	dir := os.Getenv("MC_CONFIG_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".mc")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// read the aliases of the config of the Minio client.
+func readMcAliases() (map[string]mcAlias, error) {
+	path := mcConfigPath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the Minio client config. <ERROR> %v", err)
+	}
+	var config mcConfig
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Unable to parse the Minio client config %s. <ERROR> %v", path, err)
+	}
+	if config.Aliases != nil {
+		return config.Aliases, nil
+	}
+	return config.Hosts, nil
+}
+
+// read the keys of an alias of the config of the Minio client.
+func readMcAlias(name string) (accessKey, secretKey string, err error) {
+	aliases, err := readMcAliases()
+	if err != nil {
+		return "", "", err
+	}
+	alias, ok := aliases[name]
+	if !ok {
+		return "", "", fmt.Errorf("No alias %s in %s.", name, mcConfigPath())
+	}
+	if alias.AccessKey == "" || alias.SecretKey == "" {
+		return "", "", fmt.Errorf("The alias %s of %s has no keys.", name, mcConfigPath())
+	}
+	return alias.AccessKey, alias.SecretKey, nil
+}
+
+// return the alias of the Minio client config whose URL is the endpoint, empty if there is none.
+func findMcAlias(endpoint string) string {
+	aliases, err := readMcAliases()
+	if err != nil {
+		return ""
+	}
+	for name, alias := range aliases {
+		if sameEndpoint(alias.URL, endpoint) && alias.AccessKey != "" && alias.SecretKey != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// findCredentialProvider - Sets the provider of the keys of a volume created without keys,
+// the first provider of the chain which has keys for it. Only the provider is set, not the keys.
+func findCredentialProvider(config *serverConfig) error {
+	if config.accessKey != "" || config.hasCredentialRef() {
+		return nil
+	}
+	if _, _, _, err := envCredentials(); err == nil {
+		config.fromEnv = true
+		return nil
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = defaultAWSProfile
+	}
+	if _, _, err := readAWSProfile(profile); err == nil {
+		config.awsProfile = profile
+		return nil
+	}
+	if alias := findMcAlias(config.endpoint); alias != "" {
+		config.mcAlias = alias
+		return nil
+	}
+	return fmt.Errorf("No credentials found for %s. Pass -o access-key= and -o secret-key=, -o credentials=, -o profile= or -o alias=, "+
+		"or set %s and %s in the environment of the plugin.", config.endpoint, minioAccessKeyEnv, minioSecretKeyEnv)
+}
+
+// credentialSource - Returns where the keys of the volume come from, shown in its status.
+func (config serverConfig) credentialSource() string {
+	switch config.sts {
+	case stsMetadata:
+		return "metadata:" + config.metadataURL
+	case stsAssumeRole:
+		config.sts = ""
+		return "assume-role:" + config.credentialSource()
+	}
+	switch {
+	case config.secret != "":
+		return secretRefPrefix + config.secret
+	case config.accessKeyFile != "" || config.secretKeyFile != "":
+		return "files"
+	case config.fromEnv:
+		if _, _, source, err := envCredentials(); err == nil {
+			return "env:" + source
+		}
+		return "env"
+	case config.awsProfile != "":
+		return "aws-profile:" + config.awsProfile
+	case config.mcAlias != "":
+		return "mc-alias:" + config.mcAlias
+	case config.server != "":
+		return "server:" + config.server
+	}
+	return "options"
+}
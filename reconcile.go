@@ -0,0 +1,207 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/minio/minio-go/pkg/set"
+)
+
+// The kernel lists the mounts visible to the plugin process here.
+const mountInfoPath = "/proc/self/mountinfo"
+
+// `mountEntry` is a single line of /proc/self/mountinfo.
+// Only the fields needed to match a mount to a volume are kept.
+type mountEntry struct {
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// read the mounts visible to the plugin, indexed by mountpoint.
+func readMountInfo(path string) (map[string]mountEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
+
+// parse the mountinfo format, described in `man 5 proc`.
+// ex: 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+// The optional fields before the `-` separator vary in number.
+func parseMountInfo(r io.Reader) (map[string]mountEntry, error) {
+	entries := make(map[string]mountEntry)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		entry := mountEntry{mountPoint: unescapeMountPath(fields[4])}
+		// find the separator, file system type and source follow it.
+		for i := 5; i < len(fields); i++ {
+			if fields[i] != "-" {
+				continue
+			}
+			if i+1 < len(fields) {
+				entry.fsType = fields[i+1]
+			}
+			if i+2 < len(fields) {
+				entry.source = unescapeMountPath(fields[i+2])
+			}
+			break
+		}
+		entries[entry.mountPoint] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// The kernel escapes space, tab, newline and backslash in paths as octal (ex: `\040`).
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// verifies whether a mount is listed at the path in /proc/self/mountinfo.
+func isMountPoint(path string) (bool, error) {
+	mounted, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return false, fmt.Errorf("Unable to read %s: %v", mountInfoPath, err)
+	}
+	_, ok := mounted[path]
+	return ok, nil
+}
+
+// verifies whether the FUSE process serving the mountpoint is gone.
+// Such a mountpoint stays in the mount table and every access fails with
+// "transport endpoint is not connected" until it is unmounted.
+func isStaleMount(path string) bool {
+	_, err := os.Stat(path)
+	if err == nil {
+		return false
+	}
+	if pErr, ok := err.(*os.PathError); ok {
+		return pErr.Err == syscall.ENOTCONN
+	}
+	return false
+}
+
+// reconcile - Matches the saved volumes against the mounts which are live after a restart of the plugin.
+// The plugin could have been restarted (or have crashed) while containers were still using the volumes,
+// in which case the FUSE mounts are either still alive or left behind stale.
+// For every saved volume,
+//   - a live mount which was held by containers is kept, and its holders are restored.
+//   - a live mount which no container was using is unmounted.
+//   - a stale mount is unmounted, and mounted again if containers were using it.
+//   - a volume which was in use but isn't mounted anymore is mounted again.
+//
+// Failures are logged and the volume is left without holders and marked as degraded, docker will
+// call `Mount` again for the next container which uses it. A mount which couldn't be unmounted
+// stays in the mount table, `Remove` refuses to delete its mountpoint.
+func (d *minfsDriver) reconcile() error {
+	d.Lock()
+	defer d.Unlock()
+
+	mounted, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read %s: %v", mountInfoPath, err)
+	}
+
+	for name, v := range d.mounts {
+		log := logrus.WithFields(logrus.Fields{
+			"operation":  "reconcile",
+			"volume":     name,
+			"mountpoint": v.mountPoint,
+			"mountIDs":   v.mountIDs.ToSlice(),
+		})
+
+		_, isMounted := mounted[v.mountPoint]
+		stale := isMounted && isStaleMount(v.mountPoint)
+
+		switch {
+		case isMounted && !stale && !v.mountIDs.IsEmpty():
+			log.Info("Mount is alive, restored the holders of the mount.")
+			continue
+		case isMounted && !stale:
+			log.Info("Mount is not used by any container, unmounting.")
+			if err := d.unmountVolume(*v); err != nil {
+				withMountOutput(log, err).Errorf("Unable to unmount. <ERROR> %v", err)
+				v.setDegraded(err)
+			}
+			v.mountIDs = set.NewStringSet()
+			continue
+		case stale:
+			log.Warn("Mount is stale, unmounting.")
+			if err := d.unmountVolume(*v); err != nil {
+				withMountOutput(log, err).Errorf("Unable to unmount stale mount. <ERROR> %v", err)
+				v.setDegraded(err)
+				v.mountIDs = set.NewStringSet()
+				continue
+			}
+		}
+		// the volume isn't mounted at this point.
+		if v.mountIDs.IsEmpty() {
+			continue
+		}
+		log.Info("Volume was in use, mounting it again.")
+		if err := createDir(v.mountPoint); err != nil {
+			log.Errorf("Error creating directory for the mountpoint. <ERROR> %v", err)
+			v.setDegraded(err)
+			v.mountIDs = set.NewStringSet()
+			continue
+		}
+		expiresAt, err := d.mountVolume(*v)
+		if err != nil {
+			withMountOutput(log, err).Errorf("Mount failed: <ERROR> %v", err)
+			v.setDegraded(err)
+			v.mountIDs = set.NewStringSet()
+			continue
+		}
+		v.credentialsExpireAt = expiresAt
+	}
+
+	return d.store.save(d.mounts)
+}
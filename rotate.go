@@ -0,0 +1,171 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/minio/minio-go"
+)
+
+// rotateRequest - Replaces the access-key and secret-key of a single volume (`Volume`),
+// or of every volume on a Minio server (`Endpoint`).
+// The request is posted as JSON to `/credentials/rotate` on the admin socket,
+// ex: {"Endpoint": "https://play.minio.io:9000", "AccessKey": "...", "SecretKey": "..."}
+type rotateRequest struct {
+	Volume    string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+}
+
+// rotateResponse - The volumes whose credentials were replaced.
+// The volumes in `Pending` are in use, their mounts keep the old keys until they are mounted again.
+type rotateResponse struct {
+	Volumes []string
+	Pending []string
+}
+
+// rotateCredentials - Replaces the credentials of one volume, or of all volumes on an endpoint, in place.
+// The new keys are validated against the server for every volume before anything is changed,
+// the volumes keep their name and mountpoint so containers and docker don't notice the rotation.
+// Volumes which aren't in use pick up the new keys at their next mount,
+// volumes in use are marked as pending until the last container releases them.
+func (d *minfsDriver) rotateCredentials(req rotateRequest) (rotateResponse, error) {
+	if (req.Volume == "") == (req.Endpoint == "") {
+		return rotateResponse{}, fmt.Errorf("Exactly one of volume or endpoint has to be set.")
+	}
+	if req.AccessKey == "" || req.SecretKey == "" {
+		return rotateResponse{}, fmt.Errorf("access-key and secret-key cannot be empty.")
+	}
+	registerSecrets(req.AccessKey, req.SecretKey)
+
+	// collect the volumes and their configs, the keys are validated without holding the lock.
+	// the keys of volumes reading them from files, a provider or a server profile are rotated there,
+	// a reload of the config file would put the keys of the profile back.
+	d.RLock()
+	configs := make(map[string]serverConfig)
+	fileRefs := make(map[string]string)
+	for name, v := range d.mounts {
+		if name == req.Volume || (req.Endpoint != "" && sameEndpoint(v.config.endpoint, req.Endpoint)) {
+			if v.config.hasCredentialRef() || v.config.server != "" {
+				fileRefs[name] = v.config.credentialSource()
+				continue
+			}
+			configs[name] = v.config
+		}
+	}
+	d.RUnlock()
+	if source, ok := fileRefs[req.Volume]; ok {
+		return rotateResponse{}, fmt.Errorf("The keys of volume %s come from %s, replace them there instead.", req.Volume, source)
+	}
+	for name, source := range fileRefs {
+		logrus.WithFields(logrus.Fields{
+			"operation": "rotate credentials",
+			"volume":    name,
+			"source":    source,
+		}).Info("Skipping the volume, its keys aren't saved with it.")
+	}
+	if len(configs) == 0 {
+		if req.Volume != "" {
+			return rotateResponse{}, fmt.Errorf("volume %s not found", req.Volume)
+		}
+		return rotateResponse{}, fmt.Errorf("No volumes found on endpoint %s", req.Endpoint)
+	}
+
+	var names []string
+	for name, config := range configs {
+		config.accessKey = req.AccessKey
+		config.secretKey = req.SecretKey
+		if err := validateCredentials(config); err != nil {
+			return rotateResponse{}, fmt.Errorf("New credentials rejected for volume %s: %v", name, err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	d.Lock()
+	defer d.Unlock()
+
+	var resp rotateResponse
+	old := make(map[string]serverConfig)
+	for _, name := range names {
+		v, ok := d.mounts[name]
+		// removed while the keys were validated.
+		if !ok {
+			continue
+		}
+		old[name] = v.config
+		v.config.accessKey = req.AccessKey
+		v.config.secretKey = req.SecretKey
+		resp.Volumes = append(resp.Volumes, name)
+	}
+	if err := d.store.save(d.mounts); err != nil {
+		// restore the old keys, the saved state still has them.
+		for name, config := range old {
+			d.mounts[name].config = config
+		}
+		return rotateResponse{}, err
+	}
+
+	now := time.Now().UTC()
+	for _, name := range resp.Volumes {
+		v := d.mounts[name]
+		v.credentialsRotatedAt = now
+		if !v.mountIDs.IsEmpty() {
+			v.credentialsPending = true
+			resp.Pending = append(resp.Pending, name)
+		}
+		logrus.WithFields(logrus.Fields{
+			"operation": "rotate credentials",
+			"volume":    name,
+			"endpoint":  v.config.endpoint,
+			"pending":   v.credentialsPending,
+		}).Info("Credentials rotated.")
+	}
+	return resp, nil
+}
+
+// verifies that the server accepts the credentials of the config and that the bucket exists.
+func validateCredentials(config serverConfig) error {
+	client, err := newMinioClient(config)
+	if err != nil {
+		return err
+	}
+	return checkBucket(client, config.bucket)
+}
+
+// verify that the bucket exists and is reachable by the client.
+func checkBucket(client *minio.Client, bucket string) error {
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	return nil
+}
+
+// endpoints are compared without their trailing slash.
+func sameEndpoint(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
@@ -0,0 +1,139 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/minio/minio-go/pkg/set"
+)
+
+// Values of `--shutdown-unmount`, the mounts unmounted when the plugin stops.
+const (
+	// every mount is left in place, the next start of the plugin restores them (see reconcile.go).
+	shutdownUnmountNone = "none"
+	// only the mounts no container holds are unmounted, the busy ones are kept.
+	shutdownUnmountIdle = "idle"
+	// every mount is unmounted, containers using the volumes lose access to them.
+	shutdownUnmountAll = "all"
+)
+
+// verify the value of `--shutdown-unmount`.
+func validateShutdownUnmount(mode string) error {
+	switch mode {
+	case shutdownUnmountNone, shutdownUnmountIdle, shutdownUnmountAll:
+		return nil
+	}
+	return fmt.Errorf("Invalid value \"%s\" for --shutdown-unmount, it has to be one of %s, %s or %s.",
+		mode, shutdownUnmountNone, shutdownUnmountIdle, shutdownUnmountAll)
+}
+
+// drain - Rejects new calls from docker, and waits up to `timeout` for the calls in flight to finish.
+// Returns false if they didn't finish in time.
+func (i *instrumentedDriver) drain(timeout time.Duration) bool {
+	atomic.StoreInt32(&i.draining, 1)
+
+	done := make(chan struct{})
+	go func() {
+		// only granted once every call in flight released its read lock.
+		i.requests.Lock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown - Stops the plugin after SIGTERM or SIGINT.
+// No new connections are accepted on any of the `listeners`, the calls in flight are finished, the mounts
+// are unmounted as chosen with `--shutdown-unmount`, the state is saved and the sockets are removed.
+func shutdown(drv *instrumentedDriver, listeners []net.Listener, files []string, timeout time.Duration, unmount string) {
+	// stop accepting connections, docker retries against the restarted plugin.
+	for _, l := range listeners {
+		l.Close()
+	}
+	if !drv.drain(timeout) {
+		logrus.Warnf("Calls still in flight after %s, shutting down anyway.", timeout)
+	}
+
+	d := drv.d
+	d.Lock()
+	d.unmountOnShutdown(unmount)
+	if err := d.store.save(d.mounts); err != nil {
+		logrus.Errorf("Unable to save the state of the volumes. <ERROR> %v", err)
+	}
+	d.Unlock()
+
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("Unable to remove %s. <ERROR> %v", path, err)
+		}
+	}
+	logrus.Info("Shutdown complete.")
+}
+
+// unmount the mounts chosen by the mode, the lock of the driver has to be held.
+func (d *minfsDriver) unmountOnShutdown(mode string) {
+	if mode == shutdownUnmountNone {
+		return
+	}
+	mounted, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		logrus.Errorf("Unable to read the live mounts. <ERROR> %v", err)
+		return
+	}
+
+	for name, v := range d.mounts {
+		_, live := mounted[v.mountPoint]
+		busy := !v.mountIDs.IsEmpty()
+		log := logrus.WithFields(logrus.Fields{
+			"operation":  "shutdown",
+			"volume":     name,
+			"mountpoint": v.mountPoint,
+			"busy":       busy,
+		})
+		if !busy && !live {
+			continue
+		}
+		if busy && mode != shutdownUnmountAll {
+			log.Info("Keeping the mount of the busy volume.")
+			continue
+		}
+		// the remount runs its helpers without the lock, unmounting now would race with them.
+		if v.remounting {
+			log.Warn("Keeping the mount of the volume being remounted.")
+			continue
+		}
+		if err := d.unmountVolume(*v); err != nil {
+			withMountOutput(log, err).Errorf("Unmount failed. <ERROR> %v", err)
+			continue
+		}
+		// the containers lost the mount, the next start must not restore it.
+		v.mountIDs = set.NewStringSet()
+		v.credentialsPending = false
+		v.health = volumeHealth{}
+		log.Info("Unmounted.")
+	}
+}
@@ -0,0 +1,269 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/pkg/set"
+)
+
+const (
+	// name of the file inside `--state-dir` in which the volume registry is saved.
+	stateFileName = "volumes.json"
+	// version of the on-disk format, bumped whenever the layout changes.
+	// 2: the keys can be encrypted, see statekey.go.
+	stateVersion = 2
+)
+
+// `volumeState` is the on-disk representation of a single volume.
+// `mountInfo` and `serverConfig` keep their fields unexported,
+// so the fields which have to survive a restart of the plugin are copied here.
+type volumeState struct {
+	Name       string `json:"name"`
+	MountPoint string `json:"mountpoint"`
+	Endpoint   string `json:"endpoint"`
+	Bucket     string `json:"bucket"`
+	// encrypted if a state key is configured.
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	Backend   string `json:"backend"`
+	Region    string `json:"region"`
+	// server profile of the volume, its settings are applied again when the config file is loaded.
+	Server             string `json:"server,omitempty"`
+	CAFile             string `json:"caFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+	// references of the keys kept in files, the keys aren't saved for such volumes.
+	AccessKeyFile string `json:"accessKeyFile,omitempty"`
+	SecretKeyFile string `json:"secretKeyFile,omitempty"`
+	Secret        string `json:"secret,omitempty"`
+	// provider of the keys of volumes created without them.
+	FromEnv    bool   `json:"fromEnv,omitempty"`
+	AWSProfile string `json:"awsProfile,omitempty"`
+	MCAlias    string `json:"mcAlias,omitempty"`
+	// temporary credentials, the long-lived keys above sign AssumeRole.
+	STS         string `json:"sts,omitempty"`
+	STSEndpoint string `json:"stsEndpoint,omitempty"`
+	RoleARN     string `json:"roleArn,omitempty"`
+	// in seconds.
+	STSDuration int64     `json:"stsDuration,omitempty"`
+	MetadataURL string    `json:"metadataUrl,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// IDs of the containers using the volume when the state was saved,
+	// used to rebuild the holders of live mounts after a restart.
+	MountIDs []string `json:"mountIDs"`
+}
+
+// `stateFile` is the layout of the state file.
+type stateFile struct {
+	Version int           `json:"version"`
+	Volumes []volumeState `json:"volumes"`
+}
+
+// stateStore - Saves the volume registry of the driver to disk.
+// Without it every restart of the plugin forgets the volumes created with
+// `$ docker volume create -d minfs`, and docker reports them as missing.
+// The registry is written to `--state-dir` on every `Create`, `Remove`, `Mount` and `Unmount`,
+// and is loaded by `newMinfsDriver` when the plugin starts.
+type stateStore struct {
+	// path of the state file.
+	path string
+	// keys encrypting the credentials, and the source of the current key read again by `rekeyState`.
+	keys      stateKeys
+	keySource stateKeySource
+}
+
+// return a new instance of stateStore, the state directory is created if it doesn't exist.
+// The state keys are read from their sources, see statekey.go.
+func newStateStore(stateDir string, keySource, previousKeySource stateKeySource) (*stateStore, error) {
+	keys, err := loadStateKeys(keySource, previousKeySource)
+	if err != nil {
+		return nil, err
+	}
+	if err = createDir(stateDir); err != nil {
+		return nil, err
+	}
+	return &stateStore{
+		path:      filepath.Join(stateDir, stateFileName),
+		keys:      keys,
+		keySource: keySource,
+	}, nil
+}
+
+// load the saved volumes, and whether some of their credentials aren't encrypted with the current key.
+// Such volumes are encrypted with it by saving them again.
+// An empty registry is returned if the state file doesn't exist yet.
+func (s *stateStore) load() (map[string]*mountInfo, bool, error) {
+	mounts := make(map[string]*mountInfo)
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return mounts, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var sf stateFile
+	if err = json.Unmarshal(data, &sf); err != nil {
+		return nil, false, fmt.Errorf("Unable to parse state file %s: %v", s.path, err)
+	}
+	// version 1 has the same layout, with the keys in plain text.
+	if sf.Version < 1 || sf.Version > stateVersion {
+		return nil, false, fmt.Errorf("Unsupported version %d of state file %s", sf.Version, s.path)
+	}
+
+	stale := false
+	for _, vs := range sf.Volumes {
+		// a volume which can't be decrypted fails the load, it is never dropped.
+		accessKey, staleAccessKey, err := s.keys.decrypt(vs.Name, "accessKey", vs.AccessKey)
+		if err != nil {
+			return nil, false, err
+		}
+		secretKey, staleSecretKey, err := s.keys.decrypt(vs.Name, "secretKey", vs.SecretKey)
+		if err != nil {
+			return nil, false, err
+		}
+		stale = stale || staleAccessKey || staleSecretKey
+		registerSecrets(accessKey, secretKey)
+		mounts[vs.Name] = &mountInfo{
+			config: serverConfig{
+				endpoint:      vs.Endpoint,
+				bucket:        vs.Bucket,
+				accessKey:     accessKey,
+				secretKey:     secretKey,
+				backend:       vs.Backend,
+				region:        vs.Region,
+				server:        vs.Server,
+				caFile:        vs.CAFile,
+				insecure:      vs.InsecureSkipVerify,
+				accessKeyFile: vs.AccessKeyFile,
+				secretKeyFile: vs.SecretKeyFile,
+				secret:        vs.Secret,
+				fromEnv:       vs.FromEnv,
+				awsProfile:    vs.AWSProfile,
+				mcAlias:       vs.MCAlias,
+				sts:           vs.STS,
+				stsEndpoint:   vs.STSEndpoint,
+				roleARN:       vs.RoleARN,
+				stsDuration:   time.Duration(vs.STSDuration) * time.Second,
+				metadataURL:   vs.MetadataURL,
+			},
+			createdAt:  vs.CreatedAt,
+			mountPoint: vs.MountPoint,
+			mountIDs:   set.CreateStringSet(vs.MountIDs...),
+		}
+	}
+	return mounts, stale, nil
+}
+
+// save the volumes to disk, this is done on every change of the volumes or their mount holders.
+// The state file is replaced atomically, a crash while saving leaves either
+// the old or the new registry behind, never a partially written one.
+func (s *stateStore) save(mounts map[string]*mountInfo) error {
+	sf := stateFile{Version: stateVersion, Volumes: []volumeState{}}
+	for name, v := range mounts {
+		accessKey, err := s.keys.encrypt(name, "accessKey", v.config.accessKey)
+		if err != nil {
+			return err
+		}
+		secretKey, err := s.keys.encrypt(name, "secretKey", v.config.secretKey)
+		if err != nil {
+			return err
+		}
+		sf.Volumes = append(sf.Volumes, volumeState{
+			Name:               name,
+			MountPoint:         v.mountPoint,
+			Endpoint:           v.config.endpoint,
+			Bucket:             v.config.bucket,
+			AccessKey:          accessKey,
+			SecretKey:          secretKey,
+			Backend:            v.config.backend,
+			Region:             v.config.region,
+			Server:             v.config.server,
+			CAFile:             v.config.caFile,
+			InsecureSkipVerify: v.config.insecure,
+			AccessKeyFile:      v.config.accessKeyFile,
+			SecretKeyFile:      v.config.secretKeyFile,
+			Secret:             v.config.secret,
+			FromEnv:            v.config.fromEnv,
+			AWSProfile:         v.config.awsProfile,
+			MCAlias:            v.config.mcAlias,
+			STS:                v.config.sts,
+			STSEndpoint:        v.config.stsEndpoint,
+			RoleARN:            v.config.roleARN,
+			STSDuration:        int64(v.config.stsDuration / time.Second),
+			MetadataURL:        v.config.metadataURL,
+			CreatedAt:          v.createdAt,
+			MountIDs:           v.mountIDs.ToSlice(),
+		})
+	}
+	// keep the file stable between saves.
+	sort.Slice(sf.Volumes, func(i, j int) bool { return sf.Volumes[i].Name < sf.Volumes[j].Name })
+
+	data, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// write `data` to a temporary file in the same directory as `path`,
+// sync it and rename it over `path`.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	// remove the temporary file on failure.
+	// once renamed this is a no-op.
+	defer os.Remove(tmpPath)
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// sync the directory so that the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
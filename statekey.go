@@ -0,0 +1,289 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// State encryption - The access-key and secret-key saved in the state file are encrypted with AES-256-GCM
+// once a key is configured, with `--state-key-file` (a file readable by root only)
+// or `--state-key-command` (a command printing the key, ex: the client of a KMS or of vault).
+// The key is 32 random bytes, base64 encoded, ex: `head -c 32 /dev/urandom | base64`.
+// Encrypted values are saved as `enc:<key-id>:<nonce and ciphertext, base64 encoded>`,
+// the volume name and the field are authenticated with them so values can't be swapped between volumes.
+// Rotating the key,
+// - on a running plugin, replace the key at its source and run `minfs rekey`, the saved credentials are
+//   re-encrypted with the new key right away.
+// - on restart, pass the old key with `--state-previous-key-file` or `--state-previous-key-command`,
+//   the credentials encrypted with it are re-encrypted with the new key when the plugin starts.
+// The plugin refuses to start when a key can't be read, or when the state file holds credentials
+// encrypted with a key it wasn't given, the volumes are never dropped.
+
+const (
+	// prefix of the encrypted values of the state file.
+	encryptedPrefix = "enc:"
+	// length of the decoded key, AES-256.
+	stateKeyLength = 32
+	// time given to `--state-key-command` to print the key.
+	stateKeyCommandTimeout = 30 * time.Second
+)
+
+// `stateKeySource` is where a key is read from, a file or a command.
+type stateKeySource struct {
+	// flags of the source, used in the errors.
+	fileFlag    string
+	commandFlag string
+	file        string
+	command     string
+}
+
+// `stateKey` encrypts and decrypts the credentials of the state file.
+type stateKey struct {
+	// first bytes of the SHA-256 of the key, saved with the values it encrypted.
+	id   string
+	aead cipher.AEAD
+}
+
+// `stateKeys` are the key used to encrypt and the previous key, only used to decrypt.
+// Without a current key the credentials are saved in plain text.
+type stateKeys struct {
+	current  *stateKey
+	previous *stateKey
+}
+
+// return whether a key is configured.
+func (src stateKeySource) isSet() bool {
+	return src.file != "" || src.command != ""
+}
+
+// readStateKey - Reads the key from its source, nil if none is configured.
+func readStateKey(src stateKeySource) (*stateKey, error) {
+	if src.file != "" && src.command != "" {
+		return nil, fmt.Errorf("--%s and --%s cannot be combined.", src.fileFlag, src.commandFlag)
+	}
+	var (
+		data []byte
+		err  error
+		name string
+	)
+	switch {
+	case src.file != "":
+		name = "--" + src.fileFlag + " " + src.file
+		data, err = readKeyFileRootOnly(src.file)
+	case src.command != "":
+		name = "--" + src.commandFlag
+		data, err = runKeyCommand(src.command)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the state key of %s. <ERROR> %v", name, err)
+	}
+	key, err := newStateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid state key from %s. <ERROR> %v", name, err)
+	}
+	return key, nil
+}
+
+// read the key file, which has to be owned by the user of the plugin and not accessible to anybody else.
+func readKeyFileRootOnly(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s is accessible to other users (mode %s), chmod 600 it.", path, fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return nil, fmt.Errorf("%s is owned by uid %d, it has to be owned by the user of the plugin (uid %d).", path, st.Uid, os.Geteuid())
+	}
+	return ioutil.ReadFile(path)
+}
+
+// run the key command with `sh -c`, its output is the key.
+func runKeyCommand(command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateKeyCommandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("the command didn't finish within %s", stateKeyCommandTimeout)
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// return the key of its base64 encoding.
+func newStateKey(data []byte) (*stateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		// the data is never printed, it could be the key in another encoding.
+		return nil, fmt.Errorf("the key has to be base64 encoded, ex: head -c %d /dev/urandom | base64", stateKeyLength)
+	}
+	if len(raw) != stateKeyLength {
+		return nil, fmt.Errorf("the key has to be %d bytes, got %d", stateKeyLength, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &stateKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// loadStateKeys - Reads the current and the previous key, the previous one is only set with the current one.
+func loadStateKeys(current, previous stateKeySource) (stateKeys, error) {
+	if previous.isSet() && !current.isSet() {
+		return stateKeys{}, fmt.Errorf("--%s and --%s require --%s or --%s.",
+			previous.fileFlag, previous.commandFlag, current.fileFlag, current.commandFlag)
+	}
+	var keys stateKeys
+	var err error
+	if keys.current, err = readStateKey(current); err != nil {
+		return stateKeys{}, err
+	}
+	if keys.previous, err = readStateKey(previous); err != nil {
+		return stateKeys{}, err
+	}
+	return keys, nil
+}
+
+// return the authenticated data of a value, the volume and the field it belongs to.
+func stateValueAAD(volume, field string) []byte {
+	return []byte(volume + "/" + field)
+}
+
+// encrypt - Returns the value to save for a field of a volume, in plain text without a current key.
+func (k stateKeys) encrypt(volume, field, value string) (string, error) {
+	if value == "" || k.current == nil {
+		return value, nil
+	}
+	nonce := make([]byte, k.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.current.aead.Seal(nonce, nonce, []byte(value), stateValueAAD(volume, field))
+	return encryptedPrefix + k.current.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt - Returns the value of a field of a volume as saved by `encrypt`,
+// and whether it has to be saved again to be encrypted with the current key.
+func (k stateKeys) decrypt(volume, field, value string) (string, bool, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, value != "" && k.current != nil, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", false, fmt.Errorf("Invalid encrypted %s of volume %s.", field, volume)
+	}
+	var key *stateKey
+	for _, candidate := range []*stateKey{k.current, k.previous} {
+		if candidate != nil && candidate.id == parts[0] {
+			key = candidate
+			break
+		}
+	}
+	if key == nil {
+		if k.current == nil {
+			return "", false, fmt.Errorf("The credentials of volume %s are encrypted, pass the key with --state-key-file or --state-key-command.", volume)
+		}
+		return "", false, fmt.Errorf("The credentials of volume %s are encrypted with the key %s, which is neither the state key nor the previous key. "+
+			"Pass the key they were encrypted with as --state-previous-key-file or --state-previous-key-command.", volume, parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < key.aead.NonceSize() {
+		return "", false, fmt.Errorf("Invalid encrypted %s of volume %s.", field, volume)
+	}
+	nonce := sealed[:key.aead.NonceSize()]
+	plain, err := key.aead.Open(nil, nonce, sealed[key.aead.NonceSize():], stateValueAAD(volume, field))
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to decrypt the %s of volume %s, the state file was modified.", field, volume)
+	}
+	return string(plain), key != k.current, nil
+}
+
+// return the ID of the current key, empty without one.
+func (k stateKeys) currentID() string {
+	if k.current == nil {
+		return ""
+	}
+	return k.current.id
+}
+
+// rekeyResponse - The key the saved credentials are encrypted with after `POST /state/rekey`.
+type rekeyResponse struct {
+	KeyID         string
+	PreviousKeyID string
+	Volumes       int
+}
+
+// rekeyState - Reads the state key again from its source, and saves the volumes encrypted with it.
+// The old key is kept as the previous key, the volumes are held in memory in plain text
+// so nothing has to be decrypted.
+func (d *minfsDriver) rekeyState() (rekeyResponse, error) {
+	if !d.store.keySource.isSet() {
+		return rekeyResponse{}, fmt.Errorf("No state key is configured, start the plugin with --state-key-file or --state-key-command.")
+	}
+	key, err := readStateKey(d.store.keySource)
+	if err != nil {
+		return rekeyResponse{}, err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	old := d.store.keys
+	d.store.keys = stateKeys{current: key, previous: old.current}
+	if err = d.store.save(d.mounts); err != nil {
+		// the saved state is still encrypted with the old key.
+		d.store.keys = old
+		return rekeyResponse{}, err
+	}
+	resp := rekeyResponse{KeyID: key.id, PreviousKeyID: old.currentID(), Volumes: len(d.mounts)}
+	logrus.WithFields(logrus.Fields{
+		"key":         resp.KeyID,
+		"previousKey": resp.PreviousKeyID,
+		"volumes":     resp.Volumes,
+	}).Info("Re-encrypted the saved credentials.")
+	return resp, nil
+}
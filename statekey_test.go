@@ -0,0 +1,241 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/pkg/set"
+)
+
+// write a state key made of the byte `seed` to `path`, readable by the owner only.
+func writeTestStateKey(t *testing.T, path string, seed byte) {
+	key := bytes.Repeat([]byte{seed}, stateKeyLength)
+	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// return the keys read from the key files `current` and `previous`, either can be empty.
+func testStateKeys(t *testing.T, current, previous string) stateKeys {
+	keys, err := loadStateKeys(
+		stateKeySource{fileFlag: "state-key-file", commandFlag: "state-key-command", file: current},
+		stateKeySource{fileFlag: "state-previous-key-file", commandFlag: "state-previous-key-command", file: previous})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return keys
+}
+
+// Tests encrypting and decrypting the credentials of the state file.
+func TestStateKeyEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minfs-statekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestStateKey(t, filepath.Join(dir, "key-a"), 'a')
+	writeTestStateKey(t, filepath.Join(dir, "key-b"), 'b')
+	keyA := testStateKeys(t, filepath.Join(dir, "key-a"), "")
+	keyB := testStateKeys(t, filepath.Join(dir, "key-b"), "")
+
+	secret := "zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG"
+	sealed, err := keyA.encrypt("medical-imaging", "secretKey", secret)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(sealed, encryptedPrefix+keyA.currentID()+":") || strings.Contains(sealed, secret) {
+		t.Fatalf("Expected a value encrypted with the key %s, got %s", keyA.currentID(), sealed)
+	}
+	// the same value is encrypted with a new nonce every time.
+	if again, _ := keyA.encrypt("medical-imaging", "secretKey", secret); again == sealed {
+		t.Errorf("Expected a new nonce for every encryption.")
+	}
+
+	// round trip.
+	plain, stale, err := keyA.decrypt("medical-imaging", "secretKey", sealed)
+	if err != nil || plain != secret || stale {
+		t.Errorf("Expected \"%s\", got \"%s\" (stale %v, %v)", secret, plain, stale, err)
+	}
+
+	testCases := []struct {
+		keys   stateKeys
+		volume string
+		field  string
+		err    string
+	}{
+		// the value is bound to its volume and field.
+		{keyA, "other-volume", "secretKey", "the state file was modified"},
+		{keyA, "medical-imaging", "accessKey", "the state file was modified"},
+		// a key which didn't encrypt the value.
+		{keyB, "medical-imaging", "secretKey", "which is neither the state key nor the previous key"},
+		{stateKeys{}, "medical-imaging", "secretKey", "pass the key with --state-key-file or --state-key-command"},
+	}
+	for i, testCase := range testCases {
+		plain, _, err := testCase.keys.decrypt(testCase.volume, testCase.field, sealed)
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("Test %d: Expected an error containing \"%s\", got %v", i+1, testCase.err, err)
+		}
+		if plain != "" || (err != nil && strings.Contains(err.Error(), secret)) {
+			t.Errorf("Test %d: The secret leaked: \"%s\" %v", i+1, plain, err)
+		}
+	}
+
+	// the previous key still decrypts, the value has to be saved again with the current key.
+	rotated := testStateKeys(t, filepath.Join(dir, "key-b"), filepath.Join(dir, "key-a"))
+	plain, stale, err = rotated.decrypt("medical-imaging", "secretKey", sealed)
+	if err != nil || plain != secret || !stale {
+		t.Errorf("Expected \"%s\" from the previous key, got \"%s\" (stale %v, %v)", secret, plain, stale, err)
+	}
+
+	// without a key the values are saved in plain text.
+	if value, _ := (stateKeys{}).encrypt("medical-imaging", "secretKey", secret); value != secret {
+		t.Errorf("Expected the value in plain text without a key, got %s", value)
+	}
+}
+
+// Tests loading a state file of version 1, with the keys in plain text, and encrypting it.
+func TestStateLoadPlainText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minfs-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "state.key")
+	writeTestStateKey(t, keyFile, 'a')
+
+	v1 := `{"version": 1, "volumes": [{"name": "medical-imaging", "mountpoint": "/mnt/minfs/medical-imaging",
+"endpoint": "https://play.minio.io:9000", "bucket": "medical-imaging",
+"accessKey": "Q3AM3UQ867SPQQA43P2F", "secretKey": "zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG",
+"backend": "minfs", "region": "us-east-1", "createdAt": "2017-03-01T12:00:00Z", "mountIDs": ["c1"]}]}`
+	if err = ioutil.WriteFile(filepath.Join(dir, stateFileName), []byte(v1), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newStateStore(dir, stateKeySource{file: keyFile}, stateKeySource{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mounts, stale, err := store.load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	v, ok := mounts["medical-imaging"]
+	if !ok || v.config.accessKey != "Q3AM3UQ867SPQQA43P2F" || v.config.secretKey != "zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG" ||
+		!v.mountIDs.Contains("c1") {
+		t.Fatalf("Unexpected volumes %+v", mounts)
+	}
+	if !stale {
+		t.Errorf("Expected the plain text keys to be saved again.")
+	}
+
+	// saved again, the keys are encrypted.
+	if err = store.save(mounts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	data, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sf stateFile
+	if err = json.Unmarshal(data, &sf); err != nil {
+		t.Fatal(err)
+	}
+	if sf.Version != stateVersion || !strings.HasPrefix(sf.Volumes[0].SecretKey, encryptedPrefix) ||
+		bytes.Contains(data, []byte("zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG")) {
+		t.Errorf("Expected the keys to be encrypted, got %s", data)
+	}
+	if mounts, stale, err = store.load(); err != nil || stale || mounts["medical-imaging"].config.accessKey != "Q3AM3UQ867SPQQA43P2F" {
+		t.Errorf("Expected the encrypted volume, got %+v (stale %v, %v)", mounts, stale, err)
+	}
+}
+
+// Tests re-encrypting the state with a new key, the old key keeps reading what it encrypted.
+func TestRekeyState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minfs-rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "state.key")
+	oldKeyFile := filepath.Join(dir, "old.key")
+	writeTestStateKey(t, keyFile, 'a')
+	writeTestStateKey(t, oldKeyFile, 'a')
+
+	store, err := newStateStore(dir, stateKeySource{file: keyFile}, stateKeySource{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	d := &minfsDriver{store: store, mounts: map[string]*mountInfo{
+		"medical-imaging": {
+			config:   serverConfig{endpoint: "https://play.minio.io:9000", bucket: "medical-imaging", accessKey: "Q3AM3UQ867SPQQA43P2F", secretKey: "zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG"},
+			mountIDs: set.NewStringSet(),
+		},
+	}}
+	if err = store.save(d.mounts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	oldID := store.keys.currentID()
+	sealedByOld, _ := store.keys.encrypt("medical-imaging", "accessKey", "Q3AM3UQ867SPQQA43P2F")
+
+	// the key is replaced at its source.
+	writeTestStateKey(t, keyFile, 'b')
+	resp, err := d.rekeyState()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.KeyID == oldID || resp.PreviousKeyID != oldID || resp.Volumes != 1 {
+		t.Errorf("Unexpected response %+v, the old key was %s", resp, oldID)
+	}
+	// the old key still reads the values it encrypted.
+	if plain, stale, err := d.store.keys.decrypt("medical-imaging", "accessKey", sealedByOld); err != nil || plain != "Q3AM3UQ867SPQQA43P2F" || !stale {
+		t.Errorf("Expected the previous key to decrypt, got \"%s\" (stale %v, %v)", plain, stale, err)
+	}
+
+	// the state file is encrypted with the new key only.
+	fresh, err := newStateStore(dir, stateKeySource{file: keyFile}, stateKeySource{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mounts, stale, err := fresh.load()
+	if err != nil || stale || mounts["medical-imaging"].config.secretKey != "zuf+tfteSlswRu7BJ86wekitnifILbZam1KYY3TG" {
+		t.Errorf("Expected the volume encrypted with the new key, got %+v (stale %v, %v)", mounts, stale, err)
+	}
+	// restarting with the old key as the previous key reads the state as well.
+	withPrevious, err := newStateStore(dir, stateKeySource{file: keyFile}, stateKeySource{file: oldKeyFile})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err = withPrevious.load(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// the old key alone can't read it anymore.
+	oldOnly, err := newStateStore(dir, stateKeySource{file: oldKeyFile}, stateKeySource{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err = oldOnly.load(); err == nil || !strings.Contains(err.Error(), resp.KeyID) {
+		t.Errorf("Expected an error naming the key %s, got %v", resp.KeyID, err)
+	}
+}
@@ -0,0 +1,490 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Temporary credentials - Volumes created with `-o sts=` never use long-lived keys against the bucket,
+// they use short-lived keys with a session token, which are fetched again before they expire.
+// `-o sts=assume-role` calls AssumeRole on the endpoint of the volume (or `-o sts-endpoint=`) with the keys of the volume,
+// which come from any of the usual sources. `-o role-arn=` and `-o sts-duration=` (default 1h) are passed along.
+// $ docker volume create -d minfs --name <volume-name> -o sts=assume-role -o credentials=secret:minio-prod -o backend=builtin ...
+// `-o sts=metadata` reads the keys from a local metadata endpoint (`-o metadata-url=`), in the format of the
+// EC2 instance and ECS container credentials, {"AccessKeyId", "SecretAccessKey", "Token", "Expiration"}.
+// $ docker volume create -d minfs --name <volume-name> -o sts=metadata -o metadata-url=http://169.254.170.2/creds -o backend=builtin ...
+// Only the builtin backend can take new keys on a live mount, the FUSE clients run as their own process.
+
+const (
+	stsAssumeRole = "assume-role"
+	stsMetadata   = "metadata"
+
+	// lifetime of the credentials asked from AssumeRole without `-o sts-duration=`, and its bounds.
+	defaultSTSDuration = time.Hour
+	minSTSDuration     = 15 * time.Minute
+	maxSTSDuration     = 12 * time.Hour
+
+	// credentials expiring within this margin are fetched again.
+	stsRefreshMargin = 5 * time.Minute
+	// how often the credentials of the mounted volumes are checked.
+	stsRefreshInterval = 30 * time.Second
+	// timeout of a request to the STS or metadata endpoint.
+	stsRequestTimeout = 10 * time.Second
+)
+
+// `stsCredentials` is a set of temporary credentials.
+type stsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	expiresAt    time.Time
+}
+
+// stsCache - The temporary credentials of the volumes, indexed by what they were fetched with.
+// Every Minio client and mount of a volume uses the cached credentials until they are about to expire,
+// volumes sharing the same settings share the credentials.
+type stsCache struct {
+	sync.Mutex
+	entries map[string]stsCredentials
+}
+
+// the temporary credentials of the process.
+var temporaryCredentials = &stsCache{entries: make(map[string]stsCredentials)}
+
+// credentialUpdater - Implemented by the backends which can replace the keys of a live mount.
+type credentialUpdater interface {
+	UpdateCredentials(v mountInfo) error
+}
+
+// verify the `-o sts=` options of `docker volume create`.
+func validateSTSOptions(options map[string]string) error {
+	mode := options["sts"]
+	for _, key := range []string{"sts-endpoint", "role-arn", "sts-duration", "metadata-url"} {
+		if options[key] != "" && mode == "" {
+			return fmt.Errorf("%s requires -o sts=%s or -o sts=%s.", key, stsAssumeRole, stsMetadata)
+		}
+	}
+	switch mode {
+	case "":
+		return nil
+	case stsAssumeRole:
+		if options["metadata-url"] != "" {
+			return fmt.Errorf("metadata-url cannot be combined with sts=%s.", stsAssumeRole)
+		}
+		if endpoint := options["sts-endpoint"]; endpoint != "" {
+			if err := validateEndpoint(endpoint); err != nil {
+				return err
+			}
+		}
+		if duration := options["sts-duration"]; duration != "" {
+			d, err := time.ParseDuration(duration)
+			if err != nil || d < minSTSDuration || d > maxSTSDuration {
+				return fmt.Errorf("Invalid sts-duration \"%s\", it has to be between %s and %s.", duration, minSTSDuration, maxSTSDuration)
+			}
+		}
+	case stsMetadata:
+		for _, key := range []string{"access-key", "secret-key", "access-key-file", "secret-key-file", "credentials", "profile", "alias",
+			"sts-endpoint", "role-arn", "sts-duration"} {
+			if options[key] != "" {
+				return fmt.Errorf("%s cannot be combined with sts=%s.", key, stsMetadata)
+			}
+		}
+		if err := validateMetadataURL(options["metadata-url"]); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Invalid sts \"%s\", it has to be %s or %s.", mode, stsAssumeRole, stsMetadata)
+	}
+
+	m, err := getMounter(options["backend"])
+	if err != nil {
+		return err
+	}
+	if _, ok := m.(credentialUpdater); !ok {
+		return fmt.Errorf("The backend %s cannot refresh the credentials of a mounted volume, use -o backend=builtin with -o sts=.", options["backend"])
+	}
+	return nil
+}
+
+// verifies that the metadata endpoint is served on the host itself, loopback or link-local.
+// The plugin runs as root, it must not be used to fetch arbitrary URLs.
+func validateMetadataURL(metadataURL string) error {
+	if metadataURL == "" {
+		return fmt.Errorf("metadata-url cannot be empty with sts=%s.", stsMetadata)
+	}
+	u, err := url.Parse(metadataURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return fmt.Errorf("Invalid metadata-url \"%s\", it has to be a http(s) URL.", metadataURL)
+	}
+	host := u.Host
+	if h, _, sErr := net.SplitHostPort(u.Host); sErr == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if host == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast())) {
+		return nil
+	}
+	return fmt.Errorf("Invalid metadata-url \"%s\", only loopback and link-local addresses are allowed.", metadataURL)
+}
+
+// return the key of the credentials in the cache, `config` has its long-lived keys resolved.
+func (config serverConfig) stsCacheKey() string {
+	secret := sha256.Sum256([]byte(config.secretKey))
+	return strings.Join([]string{
+		config.sts, config.stsEndpointURL(), config.region, config.roleARN, config.stsDuration.String(),
+		config.metadataURL, config.accessKey, hex.EncodeToString(secret[:]),
+	}, "\n")
+}
+
+// return the endpoint of AssumeRole, the endpoint of the volume unless `-o sts-endpoint=` is set.
+func (config serverConfig) stsEndpointURL() string {
+	if config.stsEndpoint != "" {
+		return config.stsEndpoint
+	}
+	return config.endpoint
+}
+
+// get - Returns the temporary credentials of the config, `config` has its long-lived keys resolved.
+// The cached credentials are returned until they are about to expire.
+func (c *stsCache) get(config serverConfig) (stsCredentials, error) {
+	key := config.stsCacheKey()
+	c.Lock()
+	defer c.Unlock()
+
+	if creds, ok := c.entries[key]; ok && time.Until(creds.expiresAt) > stsRefreshMargin {
+		return creds, nil
+	}
+	var creds stsCredentials
+	var err error
+	if config.sts == stsMetadata {
+		creds, err = fetchMetadataCredentials(config)
+	} else {
+		creds, err = assumeRole(config)
+	}
+	if err != nil {
+		return stsCredentials{}, err
+	}
+	c.entries[key] = creds
+	logrus.WithFields(logrus.Fields{
+		"sts":       config.sts,
+		"endpoint":  config.stsEndpointURL(),
+		"expiresAt": creds.expiresAt.Format(time.RFC3339),
+	}).Info("Fetched temporary credentials.")
+	return creds, nil
+}
+
+// the HTTP clients of the requests to the STS and metadata endpoints, one per TLS settings and kind of endpoint.
+var stsClients = struct {
+	sync.Mutex
+	clients map[string]*http.Client
+}{clients: make(map[string]*http.Client)}
+
+// return the HTTP client of the requests to the STS or metadata endpoint.
+// The clients are shared, so that the refreshes reuse their connections.
+func stsHTTPClient(config serverConfig) (*http.Client, error) {
+	key := fmt.Sprintf("%s:%s:%t", config.sts, config.caFile, config.insecure)
+
+	stsClients.Lock()
+	defer stsClients.Unlock()
+	if client, ok := stsClients.clients[key]; ok {
+		return client, nil
+	}
+	tlsConfig, err := serverTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: serverIdleConnTimeout,
+	}
+	if config.sts == stsMetadata {
+		// the metadata endpoint is local.
+		transport.Proxy = nil
+	}
+	client := &http.Client{Transport: transport, Timeout: stsRequestTimeout}
+	stsClients.clients[key] = client
+	return client, nil
+}
+
+// drop the HTTP clients of the STS and metadata endpoints, see stsHTTPClient.
+func resetSTSClients() {
+	stsClients.Lock()
+	defer stsClients.Unlock()
+	for key, client := range stsClients.clients {
+		client.Transport.(*http.Transport).CloseIdleConnections()
+		delete(stsClients.clients, key)
+	}
+}
+
+// `assumeRoleResponse` is the response of AssumeRole.
+type assumeRoleResponse struct {
+	Result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"Credentials"`
+	} `xml:"AssumeRoleResult"`
+}
+
+// `stsErrorResponse` is the error returned by the STS endpoint.
+type stsErrorResponse struct {
+	Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+// assumeRole - Asks the STS endpoint for temporary credentials, signed with the long-lived keys of the config.
+func assumeRole(config serverConfig) (stsCredentials, error) {
+	endpoint := config.stsEndpointURL()
+	duration := config.stsDuration
+	if duration == 0 {
+		duration = defaultSTSDuration
+	}
+	form := url.Values{}
+	form.Set("Action", "AssumeRole")
+	form.Set("Version", "2011-06-15")
+	form.Set("DurationSeconds", strconv.Itoa(int(duration.Seconds())))
+	if config.roleARN != "" {
+		form.Set("RoleArn", config.roleARN)
+		form.Set("RoleSessionName", "minfs-"+config.bucket)
+	}
+	body := form.Encode()
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/", strings.NewReader(body))
+	if err != nil {
+		return stsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signSTSRequest(req, body, config.accessKey, config.secretKey, config.region, time.Now().UTC())
+
+	client, err := stsHTTPClient(config)
+	if err != nil {
+		return stsCredentials{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		metrics.inc(metricMinioErrors, "endpoint", endpoint, "code", "network")
+		return stsCredentials{}, fmt.Errorf("AssumeRole on %s failed. <ERROR> %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return stsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		metrics.inc(metricMinioErrors, "endpoint", endpoint, "code", strconv.Itoa(resp.StatusCode))
+		var errResp stsErrorResponse
+		if xml.Unmarshal(data, &errResp) == nil && errResp.Error.Code != "" {
+			return stsCredentials{}, fmt.Errorf("AssumeRole on %s failed: %s: %s", endpoint, errResp.Error.Code, errResp.Error.Message)
+		}
+		return stsCredentials{}, fmt.Errorf("AssumeRole on %s failed: %s", endpoint, resp.Status)
+	}
+
+	var ar assumeRoleResponse
+	if err = xml.Unmarshal(data, &ar); err != nil {
+		return stsCredentials{}, fmt.Errorf("Unable to parse the response of AssumeRole on %s. <ERROR> %v", endpoint, err)
+	}
+	c := ar.Result.Credentials
+	return newSTSCredentials(c.AccessKeyID, c.SecretAccessKey, c.SessionToken, c.Expiration, "AssumeRole on "+endpoint)
+}
+
+// `metadataCredentials` is the response of a metadata endpoint.
+type metadataCredentials struct {
+	// set by the EC2 instance metadata, "Success" when the credentials are valid.
+	Code            string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// fetchMetadataCredentials - Reads temporary credentials from the local metadata endpoint of the config.
+func fetchMetadataCredentials(config serverConfig) (stsCredentials, error) {
+	client, err := stsHTTPClient(config)
+	if err != nil {
+		return stsCredentials{}, err
+	}
+	resp, err := client.Get(config.metadataURL)
+	if err != nil {
+		return stsCredentials{}, fmt.Errorf("Unable to read the credentials from %s. <ERROR> %v", config.metadataURL, err)
+	}
+	defer resp.Body.Close()
+	// the body is never printed, it holds the keys.
+	if resp.StatusCode != http.StatusOK {
+		return stsCredentials{}, fmt.Errorf("Unable to read the credentials from %s: %s", config.metadataURL, resp.Status)
+	}
+	var mc metadataCredentials
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&mc); err != nil {
+		return stsCredentials{}, fmt.Errorf("Unable to parse the credentials from %s.", config.metadataURL)
+	}
+	if mc.Code != "" && mc.Code != "Success" {
+		return stsCredentials{}, fmt.Errorf("The metadata endpoint %s returned %s.", config.metadataURL, mc.Code)
+	}
+	return newSTSCredentials(mc.AccessKeyID, mc.SecretAccessKey, mc.Token, mc.Expiration, config.metadataURL)
+}
+
+// verify the fetched credentials.
+func newSTSCredentials(accessKey, secretKey, sessionToken string, expiresAt time.Time, source string) (stsCredentials, error) {
+	if accessKey == "" || secretKey == "" || sessionToken == "" {
+		return stsCredentials{}, fmt.Errorf("The credentials from %s are incomplete.", source)
+	}
+	if time.Until(expiresAt) <= stsRefreshMargin {
+		return stsCredentials{}, fmt.Errorf("The credentials from %s expire at %s, too soon to be used.", source, expiresAt.Format(time.RFC3339))
+	}
+	return stsCredentials{
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		expiresAt:    expiresAt,
+	}, nil
+}
+
+// signSTSRequest - Signs a request to the STS endpoint with AWS signature V4 for the `sts` service.
+// The signer of minio-go only signs for `s3`.
+func signSTSRequest(req *http.Request, body, accessKey, secretKey, region string, t time.Time) {
+	payloadHash := sha256.Sum256([]byte(body))
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256") + "\n" +
+		"x-amz-date:" + req.Header.Get("X-Amz-Date") + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders, signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{t.Format("20060102"), region, "sts", "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{t.Format("20060102"), region, "sts", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sessionTokenTransport - Adds the session token of temporary credentials to the requests of a Minio client,
+// the vendored minio-go doesn't know session tokens. The token is added after the request was signed.
+type sessionTokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t sessionTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-Amz-Security-Token", t.token)
+	return t.base.RoundTrip(r)
+}
+
+// refreshCredentials - Fetches new temporary credentials for the mounted volumes before the current ones expire,
+// and hands them to the live mounts, until the plugin exits.
+// A failed refresh is retried every `stsRefreshInterval`, the mount keeps the current credentials meanwhile.
+func (d *minfsDriver) refreshCredentials() {
+	ticker := time.NewTicker(stsRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.RLock()
+		vols := make(map[string]mountInfo)
+		for name, v := range d.mounts {
+			if v.config.sts != "" && !v.mountIDs.IsEmpty() {
+				vols[name] = *v
+			}
+		}
+		d.RUnlock()
+
+		for name, v := range vols {
+			d.refreshVolumeCredentials(name, v)
+		}
+	}
+}
+
+// hand the current temporary credentials to the mount of the volume, if they changed since the last time.
+func (d *minfsDriver) refreshVolumeCredentials(name string, v mountInfo) {
+	log := logrus.WithFields(logrus.Fields{
+		"operation": "refresh credentials",
+		"volume":    name,
+		"sts":       v.config.sts,
+	})
+	config, err := resolveCredentials(v.config)
+	if err != nil {
+		log.Errorf("Unable to refresh the temporary credentials. <ERROR> %v", err)
+		return
+	}
+	if config.expiresAt.Equal(v.credentialsExpireAt) {
+		return
+	}
+	m, err := getMounter(v.config.backend)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	u, ok := m.(credentialUpdater)
+	if !ok {
+		log.Errorf("The backend %s cannot refresh the credentials of a mounted volume.", v.config.backend)
+		return
+	}
+	v.config = config
+	if err = u.UpdateCredentials(v); err != nil {
+		log.Errorf("Unable to hand the temporary credentials to the mount. <ERROR> %v", err)
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if cur, ok := d.mounts[name]; ok {
+		cur.credentialsExpireAt = config.expiresAt
+	}
+	log.WithField("expiresAt", config.expiresAt.Format(time.RFC3339)).Info("Refreshed the temporary credentials of the mount.")
+}
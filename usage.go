@@ -0,0 +1,158 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// `bucketUsage` is the number of objects and the total size of a bucket.
+type bucketUsage struct {
+	objects int64
+	bytes   int64
+	// time at which the bucket was listed.
+	updated time.Time
+	// error of the listing, if it failed.
+	err string
+}
+
+// usageCache - Caches the usage of the buckets of the volumes.
+// Computing the usage lists every object of the bucket with `ListObjectsV2`, which is too expensive
+// to do on every `docker volume ls`, and too slow for `docker run` to wait for it.
+// `Get` reports the cached usage and lists the bucket again in the background once it is older than `ttl`,
+// `List` only reports the cached values.
+type usageCache struct {
+	sync.Mutex
+	ttl time.Duration
+	// indexed by volume name.
+	entries map[string]bucketUsage
+	// the volumes whose bucket is being listed, to the ID of the listing.
+	// A single listing per volume runs at a time.
+	refreshing  map[string]uint64
+	lastRefresh uint64
+	// lists the bucket, `listUsage` outside of the tests.
+	list func(config serverConfig) bucketUsage
+}
+
+// return a new instance of usageCache, the usage of a bucket is listed again once it is older than `ttl`.
+func newUsageCache(ttl time.Duration) *usageCache {
+	return &usageCache{
+		ttl:        ttl,
+		entries:    make(map[string]bucketUsage),
+		refreshing: make(map[string]uint64),
+		list:       listUsage,
+	}
+}
+
+// return the cached usage of the volume.
+func (c *usageCache) cached(name string) (bucketUsage, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	u, ok := c.entries[name]
+	return u, ok
+}
+
+// return the cached usage of the volume, and whether there is one.
+// A missing or expired usage is listed again in the background, the next call reports it.
+func (c *usageCache) get(name string, config serverConfig) (bucketUsage, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	u, ok := c.entries[name]
+	if !ok || time.Since(u.updated) >= c.ttl {
+		c.refresh(name, config)
+	}
+	return u, ok
+}
+
+// list the bucket of the volume in the background, unless it is already being listed.
+// The lock has to be held.
+func (c *usageCache) refresh(name string, config serverConfig) {
+	if _, ok := c.refreshing[name]; ok {
+		return
+	}
+	c.lastRefresh++
+	id := c.lastRefresh
+	c.refreshing[name] = id
+
+	go func() {
+		u := c.list(config)
+		if u.err != "" {
+			logrus.WithFields(logrus.Fields{
+				"volume":   name,
+				"endpoint": config.endpoint,
+				"bucket":   config.bucket,
+			}).Errorf("Unable to compute the usage of the bucket. <ERROR> %s", u.err)
+		}
+
+		c.Lock()
+		defer c.Unlock()
+		// the volume was removed while its bucket was listed.
+		if c.refreshing[name] != id {
+			return
+		}
+		delete(c.refreshing, name)
+		c.entries[name] = u
+	}()
+}
+
+// drop the cached usage of a removed volume, a listing in progress is discarded.
+func (c *usageCache) remove(name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.entries, name)
+	delete(c.refreshing, name)
+}
+
+// count the objects of the bucket and sum up their size.
+func listUsage(config serverConfig) bucketUsage {
+	u := bucketUsage{updated: time.Now().UTC()}
+
+	client, err := newMinioClient(config)
+	if err != nil {
+		u.err = err.Error()
+		return u
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for obj := range client.ListObjectsV2(config.bucket, "", true, doneCh) {
+		if obj.Err != nil {
+			u.err = obj.Err.Error()
+			return u
+		}
+		u.objects++
+		u.bytes += obj.Size
+	}
+	return u
+}
+
+// add the usage to the status of a volume.
+func (u bucketUsage) addTo(status map[string]interface{}) {
+	status["usageUpdatedAt"] = u.updated.Format(time.RFC3339)
+	if u.err != "" {
+		status["usageError"] = redact(u.err)
+		return
+	}
+	status["objects"] = u.objects
+	status["bytes"] = u.bytes
+}
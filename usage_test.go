@@ -0,0 +1,121 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLister - Lists buckets for the usage cache, each listing blocks until it is released.
+type fakeLister struct {
+	sync.Mutex
+	calls   int
+	objects int64
+	release chan struct{}
+	done    chan struct{}
+}
+
+func newFakeLister() *fakeLister {
+	return &fakeLister{release: make(chan struct{}), done: make(chan struct{}, 10)}
+}
+
+func (f *fakeLister) list(config serverConfig) bucketUsage {
+	f.Lock()
+	f.calls++
+	f.objects += 10
+	u := bucketUsage{objects: f.objects, updated: time.Now().UTC()}
+	f.Unlock()
+
+	<-f.release
+	// signaled once the cache is updated, the update runs right after the return.
+	defer func() { f.done <- struct{}{} }()
+	return u
+}
+
+// wait until the cache handled the listing which was released.
+func (f *fakeLister) finish(t *testing.T, c *usageCache) {
+	f.release <- struct{}{}
+	select {
+	case <-f.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the listing.")
+	}
+	// the listing takes the lock of the cache to store its result.
+	for {
+		c.Lock()
+		n := len(c.refreshing)
+		c.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Tests that the usage is listed in the background, one listing per volume at a time.
+func TestUsageCacheGet(t *testing.T) {
+	f := newFakeLister()
+	c := newUsageCache(time.Hour)
+	c.list = f.list
+	config := serverConfig{endpoint: "https://play.minio.io:9000", bucket: "test-bucket"}
+
+	// nothing is cached yet, concurrent calls start a single listing.
+	for i := 0; i < 3; i++ {
+		if _, ok := c.get("test-volume", config); ok {
+			t.Fatalf("Expected no usage before the first listing.")
+		}
+	}
+	f.finish(t, c)
+	u, ok := c.get("test-volume", config)
+	if !ok || u.objects != 10 || f.calls != 1 {
+		t.Fatalf("Expected the usage of a single listing, got %+v after %d listings", u, f.calls)
+	}
+
+	// the expired usage is served while the bucket is listed again.
+	c.Lock()
+	expired := c.entries["test-volume"]
+	expired.updated = time.Now().Add(-2 * time.Hour)
+	c.entries["test-volume"] = expired
+	c.Unlock()
+	if u, ok = c.get("test-volume", config); !ok || u.objects != 10 {
+		t.Errorf("Expected the expired usage, got %+v", u)
+	}
+	f.finish(t, c)
+	if u, _ = c.get("test-volume", config); u.objects != 20 || f.calls != 2 {
+		t.Errorf("Expected the new usage, got %+v after %d listings", u, f.calls)
+	}
+}
+
+// Tests that a listing in progress doesn't bring back the usage of a removed volume.
+func TestUsageCacheRemove(t *testing.T) {
+	f := newFakeLister()
+	c := newUsageCache(time.Hour)
+	c.list = f.list
+	config := serverConfig{endpoint: "https://play.minio.io:9000", bucket: "test-bucket"}
+
+	c.get("test-volume", config)
+	c.remove("test-volume")
+	f.release <- struct{}{}
+	<-f.done
+	// give the listing the time to store its result, it must not.
+	time.Sleep(10 * time.Millisecond)
+	if u, ok := c.cached("test-volume"); ok {
+		t.Errorf("Expected no usage for the removed volume, got %+v", u)
+	}
+}
@@ -18,11 +18,18 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/minio/minio-go"
 )
 
 // return `Host` from the URL endpoint.
@@ -58,38 +65,205 @@ func getScheme(endpoint string) (string, error) {
 	return u.Scheme, nil
 }
 
+// Volume names are restricted to the characters docker allows for local volumes,
+// ex: `medical-imaging-store`.
+var validVolumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Bucket names follow the S3 naming rules, lowercase letters, numbers, dots and hyphens,
+// starting and ending with a letter or number.
+var validBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// verifies that the name of the volume can be used as a directory name under `mountroot`.
+// Names with slashes or `..` would point outside of `mountroot`.
+func validateVolumeName(name string) error {
+	if !validVolumeName.MatchString(name) || strings.Contains(name, "..") {
+		return fmt.Errorf("Invalid volume name \"%s\", only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed and \"..\" is not.", name)
+	}
+	return nil
+}
+
+// verifies the bucket name against the S3 bucket naming rules,
+// http://docs.aws.amazon.com/AmazonS3/latest/dev/BucketRestrictions.html
+func validateBucketName(bucket string) error {
+	if !validBucketName.MatchString(bucket) {
+		return fmt.Errorf("Invalid bucket name \"%s\", bucket names are 3 to 63 lowercase letters, numbers, dots and hyphens, starting and ending with a letter or number.", bucket)
+	}
+	if strings.Contains(bucket, "..") {
+		return fmt.Errorf("Invalid bucket name \"%s\", bucket names cannot have successive periods.", bucket)
+	}
+	if net.ParseIP(bucket) != nil {
+		return fmt.Errorf("Invalid bucket name \"%s\", bucket names cannot be formatted as an IP address.", bucket)
+	}
+	return nil
+}
+
+// verifies that the endpoint is a plain http(s) URL of a server, ex: https://play.minio.io:9000.
+func validateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("Invalid endpoint \"%s\": %v", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Invalid endpoint \"%s\", the scheme has to be http or https.", endpoint)
+	}
+	if u.Host == "" || strings.ContainsAny(u.Host, " \t\n") {
+		return fmt.Errorf("Invalid endpoint \"%s\", host is missing or invalid.", endpoint)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("Invalid endpoint \"%s\", only scheme, host and port are allowed, ex: https://play.minio.io:9000", endpoint)
+	}
+	return nil
+}
+
+// return a Minio client for the server of the volume.
+// Keys kept in files are read on every call.
+func newMinioClient(config serverConfig) (*minio.Client, error) {
+	config, err := resolveCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+	// find out whether the scheme of the URL is HTTPS.
+	enableSSL, err := isSSL(config.endpoint)
+	if err != nil {
+		logrus.Error("Please send a valid URL of form http(s)://my-minio.com:9000 <ERROR> ", err.Error())
+		return nil, err
+	}
+	minioHost, err := getHost(config.endpoint)
+	if err != nil {
+		logrus.Error("Please send a valid URL of form http(s)://my-minio.com:9000 <ERROR> ", err.Error())
+		return nil, err
+	}
+	client, err := minio.New(minioHost, config.accessKey, config.secretKey, enableSSL)
+	if err != nil {
+		return nil, err
+	}
+	// servers with custom TLS settings share a transport per settings, see profiles.go.
+	transport, err := serverTransports.get(config)
+	if err != nil {
+		return nil, err
+	}
+	base := http.DefaultTransport
+	if transport != nil {
+		base = transport
+	}
+	// temporary credentials are sent with their session token.
+	if config.sessionToken != "" {
+		base = sessionTokenTransport{token: config.sessionToken, base: base}
+	}
+	// failed requests are counted per endpoint, see metrics.go.
+	client.SetCustomTransport(metricsTransport{endpoint: config.endpoint, base: base})
+	return client, nil
+}
+
+// return the server config described by the options passed with `-o` to `$ docker volume create`.
+// Unset optional fields take their default values.
+func configFromOptions(options map[string]string) serverConfig {
+	config := serverConfig{
+		endpoint:  options["endpoint"],
+		bucket:    options["bucket"],
+		accessKey: options["access-key"],
+		secretKey: options["secret-key"],
+		backend:   options["backend"],
+		region:    options["region"],
+		server:    options["server"],
+		// the references of the keys, the files are read by `resolveCredentials`.
+		accessKeyFile: options["access-key-file"],
+		secretKeyFile: options["secret-key-file"],
+		awsProfile:    options["profile"],
+		mcAlias:       options["alias"],
+		sts:           options["sts"],
+		stsEndpoint:   options["sts-endpoint"],
+		roleARN:       options["role-arn"],
+		metadataURL:   options["metadata-url"],
+	}
+	// verified by `validateSTSOptions`.
+	if duration, err := time.ParseDuration(options["sts-duration"]); err == nil {
+		config.stsDuration = duration
+	}
+	if ref := options["credentials"]; ref != "" {
+		config.secret = strings.TrimPrefix(ref, secretRefPrefix)
+	}
+	config.registerSecrets()
+	if config.backend == "" {
+		config.backend = defaultBackend
+	}
+	if config.region == "" {
+		config.region = defaultLocation
+	}
+	return config
+}
+
 // If the requested volume alredy exists, then its necessary that the server configs (Minio server endpoint,
-// bucket,accessKey and secretKey matches with the existing one.
+// bucket, accessKey, secretKey and the other options) match with the existing one.
 // Since a mount is uniquely identified by its volume name its not possible to have a duplicate entry.
-func matchServerConfig(config serverConfig, r volume.Request) error {
+// On mismatch the error lists every conflicting field, the values of the keys are never printed.
+// The TLS settings of a volume created from a server profile are those of the profile in `profiles`.
+func matchServerConfig(config serverConfig, r volume.Request, profiles map[string]serverProfile) error {
 	if r.Options == nil {
 		return fmt.Errorf("No options provided. Please refer example usage.")
 	}
-	// Compare the endpoints.
-	if r.Options["endpoint"] == config.endpoint {
-		return fmt.Errorf("Volume \"%s\" already exists and is pointing to Minio server\"%s\",Cannot create duplicate volume.",
-			r.Name, config.endpoint)
-	}
-	// Compare the bucket name.
-	if r.Options["bucket"] == config.bucket {
-		return fmt.Errorf("Volume \"%s\" already exists and is pointing to Minio server \"%s\", and bucket \"%s\",Cannot create duplicate volume.",
-			r.Name, config.endpoint)
+	requested := configFromOptions(r.Options)
+	if p, ok := profiles[requested.server]; ok {
+		p.apply(&requested)
 	}
-	// compare the access keys.
-	if r.Options["access-key"] == "" {
-		return fmt.Errorf("Volume \"%s\" already exists, access key mismatch.", r.Name)
 
+	var conflicts []string
+	// compare the fields which are safe to print.
+	for _, f := range []struct {
+		name, existing, requested string
+	}{
+		{"server", config.server, requested.server},
+		{"endpoint", config.endpoint, requested.endpoint},
+		{"bucket", config.bucket, requested.bucket},
+		{"backend", config.backend, requested.backend},
+		{"region", config.region, requested.region},
+		// the references are paths and names, not the keys.
+		{"access-key-file", config.accessKeyFile, requested.accessKeyFile},
+		{"secret-key-file", config.secretKeyFile, requested.secretKeyFile},
+		{"credentials", config.secret, requested.secret},
+		{"sts", config.sts, requested.sts},
+		{"sts-endpoint", config.stsEndpoint, requested.stsEndpoint},
+		{"role-arn", config.roleARN, requested.roleARN},
+		{"sts-duration", config.stsDuration.String(), requested.stsDuration.String()},
+		{"metadata-url", config.metadataURL, requested.metadataURL},
+		{"ca-file", config.caFile, requested.caFile},
+		{"insecure-skip-verify", strconv.FormatBool(config.insecure), strconv.FormatBool(requested.insecure)},
+	} {
+		if f.existing != f.requested {
+			conflicts = append(conflicts, fmt.Sprintf("%s (existing \"%s\", requested \"%s\")", f.name, f.existing, f.requested))
+		}
+	}
+	// the provider found by the chain isn't part of the request, only an explicit one is compared.
+	for _, f := range []struct {
+		name, existing, requested string
+	}{
+		{"profile", config.awsProfile, requested.awsProfile},
+		{"alias", config.mcAlias, requested.mcAlias},
+	} {
+		if f.requested != "" && f.existing != f.requested {
+			conflicts = append(conflicts, fmt.Sprintf("%s (existing \"%s\", requested \"%s\")", f.name, f.existing, f.requested))
+		}
 	}
-	// compare the secret keys.
-	if r.Options["secret-key"] == "" {
-		return fmt.Errorf("Volume \"%s\" already exists, secret key mismatch.", r.Name)
+	// compare the keys without printing them.
+	if config.accessKey != requested.accessKey {
+		conflicts = append(conflicts, "access-key (differs)")
+	}
+	if config.secretKey != requested.secretKey {
+		conflicts = append(conflicts, "secret-key (differs)")
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("Volume \"%s\" already exists with a different configuration, cannot create duplicate volume. Conflicting options: %s.",
+			r.Name, strings.Join(conflicts, ", "))
 	}
 	// match successful, return `nil` error.
 	return nil
 }
 
 // Error repsonse to be sent to docker on failure of any operation.
+// The message is redacted, docker prints it and keeps it in its own log.
 func errorResponse(err string) volume.Response {
+	err = redact(err)
 	logrus.Error(err)
 	return volume.Response{Err: err}
 }
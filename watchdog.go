@@ -0,0 +1,261 @@
+/*
+* Minio Cloud Storage, (C) 2017 Minio, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/minio/minio-go"
+)
+
+const (
+	// a probe of the mountpoint taking longer than this is a hung FUSE process.
+	mountProbeTimeout = 10 * time.Second
+	// upper bound of the delay between two remounts of a volume which keeps failing.
+	maxRemountBackoff = 10 * time.Minute
+	// the bucket is probed at most this often, the probe is a request to the server.
+	bucketProbeInterval = 5 * time.Minute
+)
+
+// `volumeHealth` is the outcome of the checks of the watchdog for a mounted volume.
+type volumeHealth struct {
+	// time of the last check.
+	checkedAt time.Time
+	// reason of the last failed check, empty if it passed.
+	err string
+	// number of remounts done by the watchdog.
+	remounts      int
+	lastRemountAt time.Time
+	// consecutive failed remounts, the delay before the next one doubles with each of them.
+	failures      int
+	nextRemountAt time.Time
+	// time and failure of the last probe of the bucket, and the client it was done with.
+	// The client is kept for the next probes as long as the settings of the volume don't change.
+	bucketCheckedAt time.Time
+	bucketErr       string
+	client          *minio.Client
+	clientConfig    serverConfig
+}
+
+// add the health of the volume to its status.
+func (h volumeHealth) addTo(status map[string]interface{}) {
+	if h.checkedAt.IsZero() {
+		return
+	}
+	status["healthCheckedAt"] = h.checkedAt.Format(time.RFC3339)
+	status["health"] = "ok"
+	if h.err != "" {
+		status["health"] = "unhealthy"
+		status["healthError"] = h.err
+	}
+	if h.remounts > 0 {
+		status["watchdogRemounts"] = h.remounts
+		status["lastRemountAt"] = h.lastRemountAt.Format(time.RFC3339)
+	}
+	if !h.nextRemountAt.IsZero() {
+		status["nextRemountAt"] = h.nextRemountAt.Format(time.RFC3339)
+	}
+}
+
+// watch - Checks the volumes in use every `interval`, until the plugin exits.
+// A broken mount (ex: "transport endpoint is not connected" after the FUSE process died)
+// is remounted in place, the containers holding it keep holding it.
+// The containers only see the new mount through their bind mounts if `mountroot` is on a mount
+// with rshared propagation, otherwise they keep the broken mount until they are restarted.
+// A bucket which can't be reached is only reported, remounting doesn't fix the server.
+// It is probed every `bucketProbeInterval`, or every `interval` if that is longer.
+func (d *minfsDriver) watch(interval time.Duration) {
+	logrus.Infof("watchdog checks the mounted volumes every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.checkMounts(interval)
+	}
+}
+
+// check every volume in use once.
+func (d *minfsDriver) checkMounts(interval time.Duration) {
+	// the checks are done on copies, without holding the lock.
+	d.RLock()
+	vols := make(map[string]mountInfo)
+	for name, v := range d.mounts {
+		// a volume being remounted is checked once the remount is done.
+		if !v.mountIDs.IsEmpty() && !v.remounting {
+			vols[name] = *v
+		}
+	}
+	d.RUnlock()
+
+	for name, v := range vols {
+		d.checkMount(name, v, interval)
+	}
+}
+
+// check a single volume, and remount it if its mount is broken and its backoff expired.
+func (d *minfsDriver) checkMount(name string, v mountInfo, interval time.Duration) {
+	log := logrus.WithFields(logrus.Fields{
+		"operation":  "watchdog",
+		"volume":     name,
+		"mountpoint": v.mountPoint,
+		"backend":    v.config.backend,
+	})
+
+	now := time.Now().UTC()
+	mountErr := probeMount(v)
+	probeBucket := mountErr == nil && now.Sub(v.health.bucketCheckedAt) >= bucketProbeInterval
+	var bucketErr error
+	client, clientConfig := v.health.client, v.health.clientConfig
+	if probeBucket {
+		// the keys in files, providers and temporary credentials change without the settings of the volume.
+		resolved, err := resolveCredentials(v.config)
+		bucketErr = err
+		if err == nil && (client == nil || clientConfig != resolved) {
+			client, bucketErr = newMinioClient(v.config)
+			clientConfig = resolved
+		}
+		if bucketErr == nil {
+			bucketErr = checkBucket(client, v.config.bucket)
+		}
+	}
+
+	d.Lock()
+	cur, ok := d.mounts[name]
+	// removed, released or remounted while it was checked.
+	if !ok || cur.mountIDs.IsEmpty() || cur.remounting {
+		d.Unlock()
+		return
+	}
+	cur.health.checkedAt = now
+	if probeBucket {
+		cur.health.bucketCheckedAt = now
+		cur.health.bucketErr = ""
+		if bucketErr != nil {
+			cur.health.bucketErr = bucketErr.Error()
+			client = nil
+		}
+		cur.health.client, cur.health.clientConfig = client, clientConfig
+	}
+	switch {
+	case mountErr != nil:
+		cur.health.err = fmt.Sprintf("mount is broken: %v", mountErr)
+	case cur.health.bucketErr != "":
+		cur.health.err = fmt.Sprintf("bucket is unreachable: %s", cur.health.bucketErr)
+	default:
+		cur.health.err = ""
+		cur.health.failures = 0
+		cur.health.nextRemountAt = time.Time{}
+	}
+	remount := mountErr != nil && !now.Before(cur.health.nextRemountAt)
+	nextRemountAt := cur.health.nextRemountAt
+	d.Unlock()
+
+	if bucketErr != nil {
+		log.Warnf("Bucket probe failed. <ERROR> %v", bucketErr)
+	}
+	if mountErr == nil {
+		return
+	}
+	if !remount {
+		log.Warnf("Mount is broken, remount postponed until %s. <ERROR> %v", nextRemountAt.Format(time.RFC3339), mountErr)
+		return
+	}
+
+	log.Warnf("Mount is broken, remounting. <ERROR> %v", mountErr)
+	err := d.remount(name)
+
+	d.Lock()
+	defer d.Unlock()
+	cur, ok = d.mounts[name]
+	if !ok {
+		return
+	}
+	if err != nil {
+		cur.health.failures++
+		cur.health.nextRemountAt = now.Add(remountBackoff(interval, cur.health.failures))
+		withMountOutput(log, err).Errorf("Remount failed, next attempt at %s. <ERROR> %v",
+			cur.health.nextRemountAt.Format(time.RFC3339), err)
+		return
+	}
+	cur.health.err = ""
+	cur.health.remounts++
+	cur.health.lastRemountAt = now
+	cur.health.failures = 0
+	cur.health.nextRemountAt = time.Time{}
+	log.Info("Remounted the broken mount.")
+}
+
+// mountpoints whose probe is still blocked, see probeMount.
+var pendingProbes = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// verifies that the mountpoint answers and that the backend considers its mount alive.
+// A hung FUSE process blocks the probe, it is abandoned after `mountProbeTimeout`.
+// The abandoned probe stays blocked until the mount answers or goes away, no other
+// probe of the mountpoint is started meanwhile.
+func probeMount(v mountInfo) error {
+	pendingProbes.Lock()
+	if pendingProbes.paths[v.mountPoint] {
+		pendingProbes.Unlock()
+		return fmt.Errorf("%s still did not answer an earlier probe", v.mountPoint)
+	}
+	pendingProbes.paths[v.mountPoint] = true
+	pendingProbes.Unlock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			pendingProbes.Lock()
+			delete(pendingProbes.paths, v.mountPoint)
+			pendingProbes.Unlock()
+		}()
+		if _, err := os.Stat(v.mountPoint); err != nil {
+			errCh <- err
+			return
+		}
+		m, err := getMounter(v.config.backend)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- m.Check(v)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(mountProbeTimeout):
+		return fmt.Errorf("%s did not answer within %s", v.mountPoint, mountProbeTimeout)
+	}
+}
+
+// return the delay before the next remount after `failures` consecutive failed remounts.
+func remountBackoff(interval time.Duration, failures int) time.Duration {
+	backoff := interval
+	for i := 1; i < failures && backoff < maxRemountBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRemountBackoff {
+		backoff = maxRemountBackoff
+	}
+	return backoff
+}